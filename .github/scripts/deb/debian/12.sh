@@ -32,7 +32,7 @@ export PATH=$PATH:$GOROOT/bin
 cd $GITHUB_WORKSPACE
 go clean -cache -modcache -testcache -i
 go mod tidy
-go build -ldflags="-s -w" -o agent run.go
+go build -ldflags="-s -w -X main.version=${AGENT_VERSION}" -o agent .
 
 # --- Prepare DEB package structure ---
 DEB_BUILD_DIR="$GITHUB_WORKSPACE/debbuild"
@@ -60,7 +60,8 @@ WorkingDirectory=/raweb/apps/agent
 RuntimeDirectory=raweb-agent
 PIDFile=/run/raweb-agent/raweb-agent.pid
 ExecStart=/sbin/start-stop-daemon --start --background --make-pidfile --pidfile /run/raweb-agent/raweb-agent.pid --chdir /raweb/apps/agent --exec /raweb/apps/agent/agent -- --config=/raweb/apps/agent/config.json
-ExecStop=/sbin/start-stop-daemon --stop --pidfile /run/raweb-agent/raweb-agent.pid --retry=TERM/10/KILL/5
+ExecReload=/bin/kill -HUP \$MAINPID
+ExecStop=/sbin/start-stop-daemon --stop --pidfile /run/raweb-agent/raweb-agent.pid --retry=TERM/30/KILL/5
 Restart=on-failure
 RestartSec=5
 StandardOutput=journal
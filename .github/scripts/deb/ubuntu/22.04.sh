@@ -32,7 +32,7 @@ export PATH=$PATH:$GOROOT/bin
 cd $GITHUB_WORKSPACE
 go clean -cache -modcache -testcache -i
 go mod tidy
-go build -ldflags="-s -w" -o agent run.go
+go build -ldflags="-s -w -X main.version=${AGENT_VERSION}" -o agent .
 
 # --- Prepare DEB package structure ---
 DEB_BUILD_DIR="$GITHUB_WORKSPACE/debbuild"
@@ -58,6 +58,7 @@ Type=simple
 User=root
 WorkingDirectory=/raweb/apps/agent
 ExecStart=/raweb/apps/agent/agent --config=/raweb/apps/agent/config.json
+ExecReload=/bin/kill -HUP \$MAINPID
 Restart=always
 RestartSec=10
 StandardOutput=journal
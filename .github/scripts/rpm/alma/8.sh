@@ -40,7 +40,7 @@ export PATH=$PATH:$GOROOT/bin
 cd $GITHUB_WORKSPACE
 go clean -cache -modcache -testcache -i
 go mod tidy
-go build -ldflags="-s -w" -o agent run.go
+go build -ldflags="-s -w -X main.version=${AGENT_VERSION}" -o agent .
 
 cp "$GITHUB_WORKSPACE/agent" "$RPM_ROOT/raweb/apps/agent/"
 cp "$GITHUB_WORKSPACE/config.json" "$RPM_ROOT/raweb/apps/agent/"
@@ -55,6 +55,7 @@ Type=simple
 User=root
 WorkingDirectory=/raweb/apps/agent
 ExecStart=/raweb/apps/agent/agent --config=/raweb/apps/agent/config.json
+ExecReload=/bin/kill -HUP \$MAINPID
 Restart=always
 RestartSec=10
 
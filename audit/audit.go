@@ -0,0 +1,368 @@
+// Package audit records every mutating API call as one JSON line in an
+// append-only log that is rotated by size.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"agent/authorization"
+	"agent/logging"
+	"agent/server"
+)
+
+type Config struct {
+	// Path of the active log file; auditing is off when empty.
+	Path       string `json:"path"`
+	MaxSizeMB  int    `json:"max_size_mb"`
+	MaxBackups int    `json:"max_backups"`
+}
+
+// Record is one audited call.
+type Record struct {
+	Time       time.Time         `json:"time"`
+	RequestID  string            `json:"request_id,omitempty"`
+	ClientIP   string            `json:"client_ip"`
+	Identity   string            `json:"identity,omitempty"`
+	Method     string            `json:"method"`
+	Route      string            `json:"route"`
+	Path       string            `json:"path"`
+	Body       interface{}       `json:"body,omitempty"`
+	Targets    map[string]string `json:"targets,omitempty"`
+	Status     int               `json:"status"`
+	Outcome    string            `json:"outcome"`
+	DurationMS float64           `json:"duration_ms"`
+}
+
+// Outcomes.
+const (
+	OutcomeSuccess = "success"
+	OutcomeDenied  = "denied"
+	OutcomeFailure = "failure"
+)
+
+const (
+	defaultMaxSizeMB  = 50
+	defaultMaxBackups = 10
+	// Bodies above this size are not recorded; the handler still gets
+	// the whole body.
+	maxBodyBytes = 64 << 10
+	// Longer string values are cut, e.g. a full vhost in "content".
+	maxStringLen = 1024
+	// Calls rejected before authentication are recorded at most this
+	// often per second so they cannot rotate real records out.
+	maxAnonymousPerSecond = 10
+)
+
+var (
+	mu     sync.Mutex
+	cfg    Config
+	file   *os.File
+	size   int64
+	active bool
+
+	// Window for the anonymous record limit.
+	anonSecond     int64
+	anonCount      int
+	anonSuppressed int
+)
+
+type contextKey int
+
+const recordKey contextKey = iota
+
+// Init opens the log. It is a no-op when no path is configured.
+func Init(c Config) error {
+	if c.Path == "" {
+		return nil
+	}
+	if c.MaxSizeMB <= 0 {
+		c.MaxSizeMB = defaultMaxSizeMB
+	}
+	if c.MaxBackups <= 0 {
+		c.MaxBackups = defaultMaxBackups
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	cfg = c
+	if err := openLocked(); err != nil {
+		return err
+	}
+	active = true
+	return nil
+}
+
+// Close flushes and closes the log.
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if file != nil {
+		file.Sync()
+		file.Close()
+		file = nil
+	}
+	active = false
+}
+
+func openLocked() error {
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0750); err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("audit: %v", err)
+	}
+	file = f
+	size = info.Size()
+	return nil
+}
+
+// backupPath is the n-th rotated file; 1 is the most recent.
+func backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", cfg.Path, n)
+}
+
+// rotateLocked shifts path.N-1 to path.N, the active file to path.1 and
+// starts a new active file. The oldest backup falls off the end.
+func rotateLocked() error {
+	file.Close()
+	file = nil
+	os.Remove(backupPath(cfg.MaxBackups))
+	for n := cfg.MaxBackups - 1; n >= 1; n-- {
+		os.Rename(backupPath(n), backupPath(n+1))
+	}
+	if err := os.Rename(cfg.Path, backupPath(1)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("audit: %v", err)
+	}
+	return openLocked()
+}
+
+func write(rec *Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !active {
+		return nil
+	}
+	if file == nil {
+		if err := openLocked(); err != nil {
+			return err
+		}
+	}
+	if size > 0 && size+int64(len(line)) > int64(cfg.MaxSizeMB)<<20 {
+		if err := rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := file.Write(line)
+	size += int64(n)
+	return err
+}
+
+func enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return active
+}
+
+// allowAnonymous reports whether a record for a call rejected before
+// authentication may be written at t, and how many were dropped since
+// the last one that was.
+func allowAnonymous(t time.Time) (bool, int) {
+	mu.Lock()
+	defer mu.Unlock()
+	if sec := t.Unix(); sec != anonSecond {
+		anonSecond, anonCount = sec, 0
+	}
+	if anonCount >= maxAnonymousPerSecond {
+		anonSuppressed++
+		return false, 0
+	}
+	anonCount++
+	suppressed := anonSuppressed
+	anonSuppressed = 0
+	return true, suppressed
+}
+
+// Middleware records the call handled by next. It goes outside
+// AuthMiddleware so rejected calls are recorded too; Identify has to sit
+// inside it to pick up the caller and the body, which are only recorded
+// once authentication succeeded.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &Record{
+			Time:      start.UTC(),
+			RequestID: logging.RequestID(r.Context()),
+			ClientIP:  authorization.ClientIP(r),
+			Method:    r.Method,
+			Route:     r.Pattern,
+			Path:      r.URL.Path,
+		}
+		if _, ok := server.PeerCredFromContext(r.Context()); ok {
+			rec.ClientIP = "unix"
+		}
+		rec.Targets = targets(r, nil)
+
+		sw := &server.StatusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), recordKey, rec)))
+
+		rec.Status = sw.Code()
+		switch {
+		case rec.Status == http.StatusUnauthorized || rec.Status == http.StatusForbidden:
+			rec.Outcome = OutcomeDenied
+		case rec.Status >= 400:
+			rec.Outcome = OutcomeFailure
+		default:
+			rec.Outcome = OutcomeSuccess
+		}
+		rec.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+		if rec.Identity == "" && rec.Outcome == OutcomeDenied {
+			ok, suppressed := allowAnonymous(start)
+			if !ok {
+				return
+			}
+			if suppressed > 0 {
+				slog.WarnContext(r.Context(), "audit: dropped records of unauthenticated calls", "count", suppressed)
+			}
+		}
+		if err := write(rec); err != nil {
+			// Losing audit records must not go unnoticed.
+			slog.ErrorContext(r.Context(), "audit: write failed", "error", err)
+		}
+	})
+}
+
+// Identify copies the authenticated caller and the request body into
+// the record started by Middleware.
+func Identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rec, ok := r.Context().Value(recordKey).(*Record); ok {
+			rec.Identity = authorization.Identity(r)
+			rec.Body = captureBody(r)
+			rec.Targets = targets(r, rec.Body)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// captureBody reads up to maxBodyBytes of a JSON body for the record and
+// hands the handler an identical stream.
+func captureBody(r *http.Request) interface{} {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	if err != nil || len(buf) == 0 {
+		return nil
+	}
+	if len(buf) > maxBodyBytes {
+		return map[string]interface{}{"_truncated": true}
+	}
+	var v interface{}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return map[string]interface{}{"_unparsed": true}
+	}
+	return sanitize("", v)
+}
+
+var sensitiveKey = regexp.MustCompile(`(?i)pass|secret|token|key|auth|credential`)
+
+// sanitize redacts values under sensitive keys, the values of env
+// entries and overlong strings.
+func sanitize(key string, v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			if sensitiveKey.MatchString(k) {
+				val[k] = "[REDACTED]"
+				continue
+			}
+			val[k] = sanitize(k, child)
+		}
+		return val
+	case []interface{}:
+		for i, child := range val {
+			if s, ok := child.(string); ok && strings.EqualFold(key, "env") {
+				if name, _, found := strings.Cut(s, "="); found {
+					val[i] = name + "=[REDACTED]"
+					continue
+				}
+			}
+			val[i] = sanitize(key, child)
+		}
+		return val
+	case string:
+		if len(val) > maxStringLen {
+			return val[:maxStringLen] + "...[truncated]"
+		}
+	}
+	return v
+}
+
+var (
+	patternWildcard = regexp.MustCompile(`\{([A-Za-z0-9_]+)(\.\.\.)?\}`)
+	// Body fields that name the object a legacy route acts on.
+	targetFields = []string{"id", "name", "network", "container", "image", "registry", "username", "server_name"}
+)
+
+// targets collects the identifiers a call acts on from the path of /v1
+// routes and from the body of legacy ones.
+func targets(r *http.Request, body interface{}) map[string]string {
+	t := make(map[string]string)
+	for _, m := range patternWildcard.FindAllStringSubmatch(r.Pattern, -1) {
+		if v := r.PathValue(m[1]); v != "" {
+			t[m[1]] = v
+		}
+	}
+	if fields, ok := body.(map[string]interface{}); ok {
+		for _, name := range targetFields {
+			if _, set := t[name]; set {
+				continue
+			}
+			if v, ok := fields[name].(string); ok && v != "" {
+				t[name] = v
+			}
+		}
+	}
+	for _, name := range []string{"id", "name", "username", "server_name"} {
+		if _, set := t[name]; !set {
+			if v := r.URL.Query().Get(name); v != "" {
+				t[name] = v
+			}
+		}
+	}
+	if len(t) == 0 {
+		return nil
+	}
+	return t
+}
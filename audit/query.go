@@ -0,0 +1,166 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"agent/response"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// Query selects records. Zero values do not filter.
+type Query struct {
+	Since    time.Time
+	Until    time.Time
+	Route    string
+	Identity string
+	Limit    int
+}
+
+// QueryResponse is the body of /audit/query.
+type QueryResponse struct {
+	Records []Record `json:"records"`
+}
+
+func (q Query) match(rec *Record) bool {
+	if !q.Since.IsZero() && rec.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && rec.Time.After(q.Until) {
+		return false
+	}
+	if q.Route != "" && rec.Route != q.Route && !strings.HasPrefix(rec.Path, q.Route) {
+		return false
+	}
+	if q.Identity != "" && rec.Identity != q.Identity {
+		return false
+	}
+	return true
+}
+
+// Search returns the newest q.Limit matching records in chronological
+// order, reading the rotated files oldest first.
+func Search(q Query) ([]Record, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultQueryLimit
+	}
+	mu.Lock()
+	path, backups := cfg.Path, cfg.MaxBackups
+	if file != nil {
+		file.Sync()
+	}
+	mu.Unlock()
+	if path == "" {
+		return nil, nil
+	}
+
+	files := make([]string, 0, backups+1)
+	for n := backups; n >= 1; n-- {
+		files = append(files, backupPath(n))
+	}
+	files = append(files, path)
+
+	var matched []Record
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		// Every record in a file is older than the file's last write.
+		if !q.Since.IsZero() && info.ModTime().Before(q.Since) {
+			continue
+		}
+		if err := scanFile(name, q, &matched); err != nil {
+			return nil, err
+		}
+	}
+	if len(matched) > q.Limit {
+		matched = matched[len(matched)-q.Limit:]
+	}
+	return matched, nil
+}
+
+func scanFile(name string, q Query, matched *[]Record) error {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if !q.match(&rec) {
+			continue
+		}
+		*matched = append(*matched, rec)
+		// Only the newest Limit records are returned; drop the oldest
+		// half at a time so memory stays bounded on large files.
+		if len(*matched) >= 2*q.Limit {
+			*matched = append((*matched)[:0], (*matched)[len(*matched)-q.Limit:]...)
+		}
+	}
+	return scanner.Err()
+}
+
+// QueryHandler serves /audit/query. Query parameters: since and until
+// (RFC 3339), route (a route pattern or path prefix), identity and limit.
+func QueryHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := Query{
+		Route:    params.Get("route"),
+		Identity: params.Get("identity"),
+		Limit:    defaultQueryLimit,
+	}
+	for _, t := range []struct {
+		name   string
+		target *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if v := params.Get(t.name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				response.BadRequest(w, "Invalid "+t.name+": expected RFC 3339 time")
+				return
+			}
+			*t.target = parsed
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			response.BadRequest(w, "Invalid limit")
+			return
+		}
+		q.Limit = min(n, maxQueryLimit)
+	}
+
+	if !enabled() {
+		response.Fail(w, http.StatusNotFound, response.CodeNotFound, "Audit log is not enabled")
+		return
+	}
+	records, err := Search(q)
+	if err != nil {
+		response.FromError(w, err)
+		return
+	}
+	if records == nil {
+		records = []Record{}
+	}
+	response.OK(w, QueryResponse{Records: records})
+}
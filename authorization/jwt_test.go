@@ -0,0 +1,186 @@
+package authorization
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func TestJWTSecretLength(t *testing.T) {
+	for _, secret := range []string{"short", "this-is-not-currently-in-use", testSecret[:31]} {
+		if _, err := newJWTVerifier(jwtConfig{Secret: secret}); err == nil {
+			t.Errorf("secret %q accepted", secret)
+		}
+	}
+	if _, err := newJWTVerifier(jwtConfig{Secret: testSecret}); err != nil {
+		t.Errorf("32-byte secret rejected: %v", err)
+	}
+}
+
+// writePublicKey stores key's public half as PEM and returns the path
+// and the PEM bytes.
+func writePublicKey(t *testing.T, key *rsa.PrivateKey) (string, []byte) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	path := filepath.Join(t.TempDir(), "jwt.pub")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestJWTVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPath, pubPEM := writePublicKey(t, key)
+
+	now := time.Now()
+	claims := func(mod func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub": "panel",
+			"iss": "raweb-panel",
+			"aud": "raweb-agent",
+			"exp": now.Add(time.Minute).Unix(),
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+	hs256 := func(c jwt.MapClaims) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(testSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name   string
+		cfg    jwtConfig
+		token  string
+		wantOK bool
+	}{
+		{
+			name:   "valid hs256",
+			cfg:    jwtConfig{Secret: testSecret},
+			token:  hs256(claims(nil)),
+			wantOK: true,
+		},
+		{
+			name: "valid rs256",
+			cfg:  jwtConfig{PublicKey: pubPath},
+			token: func() string {
+				s, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims(nil)).SignedString(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}(),
+			wantOK: true,
+		},
+		{
+			name: "alg none",
+			cfg:  jwtConfig{Secret: testSecret},
+			token: func() string {
+				s, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims(nil)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}(),
+		},
+		{
+			name: "hs256 signed with the rs256 public key",
+			cfg:  jwtConfig{PublicKey: pubPath},
+			token: func() string {
+				s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims(nil)).SignedString(pubPEM)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}(),
+		},
+		{
+			name:  "wrong secret",
+			cfg:   jwtConfig{Secret: strings.Repeat("x", 32)},
+			token: hs256(claims(nil)),
+		},
+		{
+			name:   "issuer matches",
+			cfg:    jwtConfig{Secret: testSecret, Issuer: "raweb-panel"},
+			token:  hs256(claims(nil)),
+			wantOK: true,
+		},
+		{
+			name:  "issuer mismatch",
+			cfg:   jwtConfig{Secret: testSecret, Issuer: "someone-else"},
+			token: hs256(claims(nil)),
+		},
+		{
+			name:   "audience matches",
+			cfg:    jwtConfig{Secret: testSecret, Audience: "raweb-agent"},
+			token:  hs256(claims(nil)),
+			wantOK: true,
+		},
+		{
+			name:  "audience mismatch",
+			cfg:   jwtConfig{Secret: testSecret, Audience: "other-agent"},
+			token: hs256(claims(nil)),
+		},
+		{
+			name:  "missing exp",
+			cfg:   jwtConfig{Secret: testSecret},
+			token: hs256(claims(func(c jwt.MapClaims) { delete(c, "exp") })),
+		},
+		{
+			name:   "expired within clock skew",
+			cfg:    jwtConfig{Secret: testSecret, ClockSkew: "30s"},
+			token:  hs256(claims(func(c jwt.MapClaims) { c["exp"] = now.Add(-10 * time.Second).Unix() })),
+			wantOK: true,
+		},
+		{
+			name:  "expired beyond clock skew",
+			cfg:   jwtConfig{Secret: testSecret, ClockSkew: "30s"},
+			token: hs256(claims(func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Minute).Unix() })),
+		},
+		{
+			name:   "not yet valid within clock skew",
+			cfg:    jwtConfig{Secret: testSecret, ClockSkew: "30s"},
+			token:  hs256(claims(func(c jwt.MapClaims) { c["nbf"] = now.Add(10 * time.Second).Unix() })),
+			wantOK: true,
+		},
+		{
+			name:  "not yet valid beyond clock skew",
+			cfg:   jwtConfig{Secret: testSecret, ClockSkew: "30s"},
+			token: hs256(claims(func(c jwt.MapClaims) { c["nbf"] = now.Add(time.Minute).Unix() })),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newJWTVerifier(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = v.verify(tt.token)
+			if ok := err == nil; ok != tt.wantOK {
+				t.Errorf("verify ok = %v, want %v (err: %v)", ok, tt.wantOK, err)
+			}
+		})
+	}
+}
@@ -1,69 +1,196 @@
 package authorization
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+
+	"agent/response"
 
 	"github.com/joho/godotenv"
 )
 
-var apiToken string
-
 type agentConfig struct {
-	AllowedIPs []string `json:"allowed_ips"`
+	AllowedIPs   []string      `json:"allowed_ips"`
+	AuthMode     string        `json:"auth_mode"`
+	JWT          jwtConfig     `json:"jwt"`
+	Tokens       []tokenConfig `json:"tokens"`
+	AppKeyScopes []string      `json:"app_key_scopes"`
+	// TrustedProxies lists CIDRs or IPs allowed to set forwarding headers.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// ForwardedHeader is the one header the trusted proxies maintain:
+	// xff (default), forwarded or x-real-ip.
+	ForwardedHeader string `json:"forwarded_header"`
+	// ClientCerts maps mTLS client certificate subjects to identities.
+	ClientCerts []clientCertConfig `json:"client_certs"`
+	// PeerCredentials allowlists processes on the Unix socket listener.
+	PeerCredentials peerCredConfig `json:"peer_credentials"`
 }
 
-var (
+// Auth modes. app_key compares the bearer token with the panel APP_KEY,
+// jwt only accepts signed tokens and jwt_or_app_key tries both.
+const (
+	authModeAppKey      = "app_key"
+	authModeJWT         = "jwt"
+	authModeJWTOrAppKey = "jwt_or_app_key"
+)
+
+type contextKey int
+
+const principalKey contextKey = iota
+
+// authState is everything loaded from the panel .env and the agent
+// config. It is replaced as a whole on reload so a request never sees a
+// mix of old and new settings.
+type authState struct {
+	envPath  string
+	apiToken string
+	authMode string
+	verifier *jwtVerifier
+
 	allowAllIPs   bool
 	allowedIPNets []*net.IPNet
 	allowedIPsSet map[string]struct{}
-)
 
-func InitAuthWithPath(projectPath string) {
-	// Load APP_KEY from the panel .env
-	envPath := filepath.Join(projectPath, ".env")
-	if err := godotenv.Load(envPath); err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+	apiTokens      []tokenConfig
+	appKeyScopes   []string
+	trustedProxies []*net.IPNet
+	forwardedHdr   string
+	clientCerts    []clientCertConfig
+	peerUIDs       map[uint32]struct{}
+	peerGIDs       map[uint32]struct{}
+	peerScopes     []string
+}
+
+var state atomic.Pointer[authState]
+
+func current() *authState {
+	if st := state.Load(); st != nil {
+		return st
+	}
+	return &authState{}
+}
+
+// InitAuthWithPath loads the panel .env from projectPath and the access
+// settings from the agent config at configPath.
+func InitAuthWithPath(projectPath, configPath string) {
+	st, err := loadState(projectPath, configPath, false)
+	if err != nil {
+		slog.Error("authorization: could not load settings", "error", err)
+		os.Exit(1)
 	}
-	apiToken = os.Getenv("APP_KEY")
-	if apiToken == "" {
-		log.Fatal("APP_KEY not set in .env")
+	state.Store(st)
+}
+
+// CheckEnv reports whether the panel .env was loaded and is still
+// readable, since the next reload depends on it.
+func CheckEnv(ctx context.Context) error {
+	st := state.Load()
+	if st == nil || st.apiToken == "" {
+		return errors.New(".env not loaded")
+	}
+	if _, err := os.Stat(st.envPath); err != nil {
+		return err
 	}
+	return nil
+}
 
-	// Resolve agent config path
-	configPath := os.Getenv("AGENT_CONFIG")
-	if configPath == "" {
-		configPath = "/raweb/apps/agent/config.json"
+// PrepareReload re-reads the panel .env and the agent config. Nothing
+// changes until the returned apply is called, so the caller can validate
+// the rest of its config first; on error the running settings are kept.
+func PrepareReload(projectPath, configPath string) (apply func(), err error) {
+	st, err := loadState(projectPath, configPath, true)
+	if err != nil {
+		return nil, err
 	}
-	loadAllowedIPs(configPath)
+	return func() { state.Store(st) }, nil
 }
 
-func loadAllowedIPs(configPath string) {
-	allowAllIPs = false
-	allowedIPNets = nil
-	allowedIPsSet = make(map[string]struct{})
+// loadState builds a new authState. An unreadable agent config is only an
+// error when strict; otherwise the defaults apply.
+func loadState(projectPath, configPath string, strict bool) (*authState, error) {
+	// Load APP_KEY from the panel .env
+	envPath := filepath.Join(projectPath, ".env")
+	env, err := godotenv.Read(envPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading .env file: %v", err)
+	}
+	st := &authState{envPath: envPath, apiToken: env["APP_KEY"]}
+	if st.apiToken == "" {
+		st.apiToken = os.Getenv("APP_KEY")
+	}
+	if st.apiToken == "" {
+		return nil, errors.New("APP_KEY not set in .env")
+	}
 
-	data, err := os.ReadFile(configPath)
+	cfg, err := readAgentConfig(configPath)
 	if err != nil {
+		if strict {
+			return nil, err
+		}
 		// If config isn't available, default to allow-all (key-only)
-		allowAllIPs = true
-		log.Printf("authorization: could not read config at %s: %v; defaulting to allow-all IPs", configPath, err)
-		return
+		slog.Warn("authorization: defaulting to allow-all IPs", "error", err)
+	}
+	st.loadAllowedIPs(cfg)
+	st.loadScopes(cfg)
+	if err := st.loadTrustedProxies(cfg); err != nil {
+		return nil, err
 	}
+	st.loadClientCerts(cfg)
+	st.loadPeerCreds(cfg)
+	if err := st.loadAuthMode(cfg); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func readAgentConfig(configPath string) (agentConfig, error) {
 	var cfg agentConfig
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return cfg, fmt.Errorf("could not read config at %s: %v", configPath, err)
+	}
 	if err := json.Unmarshal(data, &cfg); err != nil {
-		allowAllIPs = true
-		log.Printf("authorization: could not parse config at %s: %v; defaulting to allow-all IPs", configPath, err)
-		return
+		return agentConfig{}, fmt.Errorf("could not parse config at %s: %v", configPath, err)
 	}
+	return cfg, nil
+}
+
+func (st *authState) loadAuthMode(cfg agentConfig) error {
+	mode := cfg.AuthMode
+	if mode == "" {
+		mode = authModeAppKey
+	}
+	switch mode {
+	case authModeAppKey:
+	case authModeJWT, authModeJWTOrAppKey:
+		v, err := newJWTVerifier(cfg.JWT)
+		if err != nil {
+			return err
+		}
+		st.verifier = v
+	default:
+		return fmt.Errorf("unknown auth_mode %q", mode)
+	}
+	st.authMode = mode
+	return nil
+}
+
+func (st *authState) loadAllowedIPs(cfg agentConfig) {
+	st.allowedIPsSet = make(map[string]struct{})
+
 	// Default to allow-all if not set
 	if len(cfg.AllowedIPs) == 0 {
-		allowAllIPs = true
+		st.allowAllIPs = true
 		return
 	}
 	// Process entries
@@ -73,57 +200,62 @@ func loadAllowedIPs(configPath string) {
 			continue
 		}
 		if e == "0.0.0.0" {
-			allowAllIPs = true
+			st.allowAllIPs = true
 			// No need to process others; keep flag set
 			continue
 		}
 		// CIDR?
 		if _, cidr, err := net.ParseCIDR(e); err == nil && cidr != nil {
-			allowedIPNets = append(allowedIPNets, cidr)
+			st.allowedIPNets = append(st.allowedIPNets, cidr)
 			continue
 		}
 		// Exact IP?
 		if ip := net.ParseIP(e); ip != nil {
-			allowedIPsSet[ip.String()] = struct{}{}
+			st.allowedIPsSet[ip.String()] = struct{}{}
 			continue
 		}
-		log.Printf("authorization: ignoring invalid allowed_ips entry: %q", e)
+		slog.Warn("authorization: ignoring invalid allowed_ips entry", "entry", e)
 	}
 }
 
-func clientIP(r *http.Request) string {
-	// Prefer X-Forwarded-For (first IP)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		if len(parts) > 0 {
-			ip := strings.TrimSpace(parts[0])
-			return ip
-		}
-	}
-	// Fallback to X-Real-IP
-	if xr := r.Header.Get("X-Real-IP"); xr != "" {
-		return strings.TrimSpace(xr)
-	}
+// clientIP only honours the configured forwarding header, and only when
+// the direct peer is a trusted proxy. The chain is walked right-to-left
+// and the first hop that is not a trusted proxy is the client.
+func (st *authState) clientIP(r *http.Request) string {
 	// RemoteAddr host part
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return r.RemoteAddr
+		remote = r.RemoteAddr
+	}
+	if !st.isTrustedProxy(remote) {
+		return remote
 	}
-	return host
+
+	chain := forwardedChain(r, st.forwardedHdr)
+	if len(chain) == 0 {
+		return remote
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !st.isTrustedProxy(chain[i]) {
+			return chain[i]
+		}
+	}
+	// Every hop is a trusted proxy; the oldest one is the best we have.
+	return chain[0]
 }
 
-func ipAllowed(ipStr string) bool {
-	if allowAllIPs {
+func (st *authState) ipAllowed(ipStr string) bool {
+	if st.allowAllIPs {
 		return true
 	}
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
 		return false
 	}
-	if _, ok := allowedIPsSet[ip.String()]; ok {
+	if _, ok := st.allowedIPsSet[ip.String()]; ok {
 		return true
 	}
-	for _, n := range allowedIPNets {
+	for _, n := range st.allowedIPNets {
 		if n.Contains(ip) {
 			return true
 		}
@@ -131,18 +263,66 @@ func ipAllowed(ipStr string) bool {
 	return false
 }
 
+// authenticate validates a bearer token according to authMode and
+// returns the caller with its granted scopes. Static tokens from the
+// config are accepted in every mode.
+func (st *authState) authenticate(token string) (principal, bool) {
+	if st.verifier != nil {
+		if claims, err := st.verifier.verify(token); err == nil {
+			identity := "jwt"
+			if sub, _ := claims.GetSubject(); sub != "" {
+				identity = "jwt:" + sub
+			}
+			return principal{Identity: identity, Scopes: claimScopes(claims)}, true
+		}
+	}
+	if p, ok := st.lookupToken(token); ok {
+		return p, true
+	}
+	if st.authMode == authModeAppKey || st.authMode == authModeJWTOrAppKey {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(st.apiToken)) == 1 {
+			return principal{Identity: "app_key", Scopes: st.appKeyScopes}, true
+		}
+	}
+	return principal{}, false
+}
+
+// ClientIP returns the caller address as resolved for the IP allowlist.
+func ClientIP(r *http.Request) string {
+	return current().clientIP(r)
+}
+
+// Identity returns the caller identity set by AuthMiddleware.
+func Identity(r *http.Request) string {
+	p, _ := r.Context().Value(principalKey).(principal)
+	return p.Identity
+}
+
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
-		if token != "Bearer "+apiToken {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		// A bearer token takes precedence over peer credentials and
+		// client certificates.
+		st := current()
+		var p principal
+		var ok bool
+		peer, peerOK, viaSocket := st.peerPrincipal(r)
+		if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			p, ok = st.authenticate(strings.TrimPrefix(header, "Bearer "))
+		} else if viaSocket {
+			p, ok = peer, peerOK
+		} else {
+			p, ok = st.certPrincipal(r)
+		}
+		if !ok {
+			response.Fail(w, http.StatusUnauthorized, response.CodeUnauthorized, "Unauthorized")
 			return
 		}
-		cip := clientIP(r)
-		if !ipAllowed(cip) {
-			http.Error(w, "Forbidden", http.StatusForbidden)
+		// Unix socket peers have no IP to check.
+		cip := st.clientIP(r)
+		if !viaSocket && !st.ipAllowed(cip) {
+			response.Fail(w, http.StatusForbidden, response.CodeForbidden, "Forbidden: client IP not allowed")
 			return
 		}
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
 	})
 }
@@ -0,0 +1,42 @@
+package authorization
+
+import (
+	"net/http"
+)
+
+// clientCertConfig maps a verified client certificate to an identity.
+// Subject matches either the full subject DN (e.g. "CN=panel,O=raweb")
+// or just the common name.
+type clientCertConfig struct {
+	Subject string   `json:"subject"`
+	Name    string   `json:"name"`
+	Scopes  []string `json:"scopes"`
+}
+
+func (st *authState) loadClientCerts(cfg agentConfig) {
+	for _, c := range cfg.ClientCerts {
+		if c.Subject != "" {
+			st.clientCerts = append(st.clientCerts, c)
+		}
+	}
+}
+
+// certPrincipal returns the identity of a client that presented a
+// certificate the listener verified against its client CA.
+func (st *authState) certPrincipal(r *http.Request) (principal, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return principal{}, false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	subject := leaf.Subject.String()
+	for _, c := range st.clientCerts {
+		if c.Subject == subject || c.Subject == leaf.Subject.CommonName {
+			name := c.Name
+			if name == "" {
+				name = leaf.Subject.CommonName
+			}
+			return principal{Identity: "cert:" + name, Scopes: c.Scopes}, true
+		}
+	}
+	return principal{}, false
+}
@@ -0,0 +1,71 @@
+package authorization
+
+import (
+	"log/slog"
+	"net/http"
+	"os/user"
+	"strconv"
+
+	"agent/server"
+)
+
+// peerCredConfig allowlists local processes connecting over the Unix
+// socket by UID/GID. Users and groups are resolved to IDs at load time.
+type peerCredConfig struct {
+	UIDs   []uint32 `json:"uids"`
+	GIDs   []uint32 `json:"gids"`
+	Users  []string `json:"users"`
+	Groups []string `json:"groups"`
+	Scopes []string `json:"scopes"`
+}
+
+func (st *authState) loadPeerCreds(cfg agentConfig) {
+	st.peerUIDs = make(map[uint32]struct{})
+	st.peerGIDs = make(map[uint32]struct{})
+	st.peerScopes = cfg.PeerCredentials.Scopes
+	if st.peerScopes == nil {
+		st.peerScopes = []string{"*"}
+	}
+	for _, uid := range cfg.PeerCredentials.UIDs {
+		st.peerUIDs[uid] = struct{}{}
+	}
+	for _, gid := range cfg.PeerCredentials.GIDs {
+		st.peerGIDs[gid] = struct{}{}
+	}
+	for _, name := range cfg.PeerCredentials.Users {
+		u, err := user.Lookup(name)
+		if err != nil {
+			slog.Warn("authorization: ignoring unknown peer_credentials user", "user", name, "error", err)
+			continue
+		}
+		if uid, err := strconv.ParseUint(u.Uid, 10, 32); err == nil {
+			st.peerUIDs[uint32(uid)] = struct{}{}
+		}
+	}
+	for _, name := range cfg.PeerCredentials.Groups {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			slog.Warn("authorization: ignoring unknown peer_credentials group", "group", name, "error", err)
+			continue
+		}
+		if gid, err := strconv.ParseUint(g.Gid, 10, 32); err == nil {
+			st.peerGIDs[uint32(gid)] = struct{}{}
+		}
+	}
+}
+
+// peerPrincipal authenticates a Unix socket caller by its SO_PEERCRED
+// UID/GID. The second result reports whether the request arrived over
+// the Unix socket at all.
+func (st *authState) peerPrincipal(r *http.Request) (principal, bool, bool) {
+	cred, ok := server.PeerCredFromContext(r.Context())
+	if !ok {
+		return principal{}, false, false
+	}
+	_, uidOK := st.peerUIDs[cred.UID]
+	_, gidOK := st.peerGIDs[cred.GID]
+	if !uidOK && !gidOK {
+		return principal{}, false, true
+	}
+	return principal{Identity: "uid:" + strconv.FormatUint(uint64(cred.UID), 10), Scopes: st.peerScopes}, true, true
+}
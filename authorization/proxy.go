@@ -0,0 +1,109 @@
+package authorization
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Values of forwarded_header.
+const (
+	forwardedXFF     = "xff"
+	forwardedRFC7239 = "forwarded"
+	forwardedXRealIP = "x-real-ip"
+)
+
+func (st *authState) loadTrustedProxies(cfg agentConfig) error {
+	st.forwardedHdr = strings.ToLower(strings.TrimSpace(cfg.ForwardedHeader))
+	switch st.forwardedHdr {
+	case "":
+		st.forwardedHdr = forwardedXFF
+	case forwardedXFF, forwardedRFC7239, forwardedXRealIP:
+	default:
+		return fmt.Errorf("unknown forwarded_header %q; use xff, forwarded or x-real-ip", cfg.ForwardedHeader)
+	}
+	for _, entry := range cfg.TrustedProxies {
+		e := strings.TrimSpace(entry)
+		if e == "" {
+			continue
+		}
+		if _, cidr, err := net.ParseCIDR(e); err == nil {
+			st.trustedProxies = append(st.trustedProxies, cidr)
+			continue
+		}
+		if ip := net.ParseIP(e); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			st.trustedProxies = append(st.trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		slog.Warn("authorization: ignoring invalid trusted_proxies entry", "entry", e)
+	}
+	return nil
+}
+
+func (st *authState) isTrustedProxy(ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range st.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedChain returns the client addresses recorded in header, oldest
+// first. Only the header the proxies are configured to maintain is read:
+// a client can send any of the others and a proxy passes them through
+// untouched.
+func forwardedChain(r *http.Request, header string) []string {
+	var chain []string
+	switch header {
+	case forwardedRFC7239:
+		for _, v := range r.Header.Values("Forwarded") {
+			for _, element := range strings.Split(v, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(key, "for") {
+						chain = append(chain, forwardedNode(value))
+					}
+				}
+			}
+		}
+	case forwardedXRealIP:
+		// A single value set by the proxy; several means a client sent
+		// its own as well, and the proxy's is the last one.
+		for _, v := range r.Header.Values("X-Real-IP") {
+			if p := strings.TrimSpace(v); p != "" {
+				chain = append(chain, p)
+			}
+		}
+	default:
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, part := range strings.Split(v, ",") {
+				if p := strings.TrimSpace(part); p != "" {
+					chain = append(chain, p)
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// forwardedNode strips quotes, brackets and port from an RFC 7239 node,
+// e.g. "[2001:db8::1]:4711" -> 2001:db8::1.
+func forwardedNode(value string) string {
+	v := strings.Trim(strings.TrimSpace(value), `"`)
+	if host, _, err := net.SplitHostPort(v); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(v, "["), "]")
+}
@@ -0,0 +1,118 @@
+package authorization
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			name:    "untrusted peer ignores headers",
+			remote:  "203.0.113.9:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"127.0.0.1"}},
+			want:    "203.0.113.9",
+		},
+		{
+			name:    "right-to-left skips trusted hops",
+			remote:  "10.0.0.1:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.7, 10.0.0.2"}},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "spoofed left-most xff entry",
+			remote:  "10.0.0.1:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"127.0.0.1, 203.0.113.9"}},
+			want:    "203.0.113.9",
+		},
+		{
+			name:    "xff split over several header lines",
+			remote:  "10.0.0.1:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"127.0.0.1", "203.0.113.9, 10.0.0.2"}},
+			want:    "203.0.113.9",
+		},
+		{
+			name:   "client Forwarded is ignored in xff mode",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"Forwarded":       {"for=127.0.0.1"},
+				"X-Forwarded-For": {"203.0.113.9"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:    "client X-Real-IP is ignored in xff mode",
+			remote:  "10.0.0.1:5000",
+			headers: map[string][]string{"X-Real-IP": {"127.0.0.1"}},
+			want:    "10.0.0.1",
+		},
+		{
+			name:    "every hop trusted returns the oldest",
+			remote:  "10.0.0.1:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:    "10.0.0.3",
+		},
+		{
+			name:   "forwarded mode reads only Forwarded",
+			header: "forwarded",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"Forwarded":       {`for=127.0.0.1, for="[2001:db8::1]:4711";proto=https`},
+				"X-Forwarded-For": {"127.0.0.1"},
+			},
+			want: "2001:db8::1",
+		},
+		{
+			name:    "forwarded mode without the header falls back to the peer",
+			header:  "forwarded",
+			remote:  "10.0.0.1:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"127.0.0.1"}},
+			want:    "10.0.0.1",
+		},
+		{
+			name:   "x-real-ip mode reads only X-Real-IP",
+			header: "x-real-ip",
+			remote: "10.0.0.1:5000",
+			headers: map[string][]string{
+				"X-Real-IP":       {"198.51.100.7"},
+				"X-Forwarded-For": {"127.0.0.1"},
+				"Forwarded":       {"for=127.0.0.1"},
+			},
+			want: "198.51.100.7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := &authState{}
+			if err := st.loadTrustedProxies(agentConfig{TrustedProxies: []string{"10.0.0.0/8"}, ForwardedHeader: tt.header}); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, vs := range tt.headers {
+				for _, v := range vs {
+					r.Header.Add(k, v)
+				}
+			}
+			if got := st.clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedHeaderConfig(t *testing.T) {
+	st := &authState{}
+	if err := st.loadTrustedProxies(agentConfig{ForwardedHeader: "x-client-ip"}); err == nil {
+		t.Error("unknown forwarded_header accepted")
+	}
+	if err := st.loadTrustedProxies(agentConfig{ForwardedHeader: "Forwarded"}); err != nil || st.forwardedHdr != forwardedRFC7239 {
+		t.Errorf("forwarded_header is case-sensitive: %v %q", err, st.forwardedHdr)
+	}
+}
@@ -0,0 +1,112 @@
+package authorization
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"agent/response"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Scopes required by the routes in routes.go. A granted scope of "*" allows
+// everything and "<resource>:*" allows every action on that resource.
+const (
+	ScopeContainerRead  = "container:read"
+	ScopeContainerWrite = "container:write"
+	ScopeContainerExec  = "container:exec"
+	ScopeNetworkRead    = "network:read"
+	ScopeNetworkAdmin   = "network:admin"
+	ScopeImageRead      = "image:read"
+	ScopeImagePull      = "image:pull"
+	ScopeImageDelete    = "image:delete"
+	ScopeUserCreate     = "user:create"
+	ScopeUserDelete     = "user:delete"
+	ScopeNginxRead      = "nginx:read"
+	ScopeNginxWrite     = "nginx:write"
+	ScopeAuditRead      = "audit:read"
+	ScopeEventsRead     = "events:read"
+)
+
+// tokenConfig is a static bearer token restricted to a set of scopes.
+type tokenConfig struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+}
+
+// principal is the authenticated caller stored in the request context.
+type principal struct {
+	Identity string
+	Scopes   []string
+}
+
+func (st *authState) loadScopes(cfg agentConfig) {
+	for _, t := range cfg.Tokens {
+		if t.Token == "" {
+			continue
+		}
+		st.apiTokens = append(st.apiTokens, t)
+	}
+	st.appKeyScopes = []string{"*"}
+	if cfg.AppKeyScopes != nil {
+		st.appKeyScopes = cfg.AppKeyScopes
+	}
+}
+
+// lookupToken matches a static token from the config.
+func (st *authState) lookupToken(token string) (principal, bool) {
+	for _, t := range st.apiTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+			return principal{Identity: "token:" + t.Name, Scopes: t.Scopes}, true
+		}
+	}
+	return principal{}, false
+}
+
+// claimScopes reads the space-delimited "scope" claim (RFC 8693) or a
+// "scopes" array.
+func claimScopes(claims jwt.MapClaims) []string {
+	if s, ok := claims["scope"].(string); ok {
+		return strings.Fields(s)
+	}
+	var scopes []string
+	if list, ok := claims["scopes"].([]interface{}); ok {
+		for _, v := range list {
+			if s, ok := v.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	return scopes
+}
+
+func scopeAllowed(granted []string, required string) bool {
+	resource, _, _ := strings.Cut(required, ":")
+	for _, g := range granted {
+		if g == "*" || g == required || g == resource+":*" {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the caller authenticated by AuthMiddleware was
+// granted scope.
+func HasScope(r *http.Request, scope string) bool {
+	p, ok := r.Context().Value(principalKey).(principal)
+	return ok && scopeAllowed(p.Scopes, scope)
+}
+
+// RequireScope rejects callers whose token does not carry scope. It must
+// run behind AuthMiddleware.
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !HasScope(r, scope) {
+			response.WriteError(w, response.NewError(http.StatusForbidden, response.CodeForbidden, "Forbidden: missing scope "+scope).WithDetails(map[string]string{"scope": scope}))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
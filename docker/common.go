@@ -1,7 +1,115 @@
 package docker
 
-var dockerHost string
+import (
+    "context"
+    "log/slog"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
 
+    "agent/logging"
+
+    "github.com/docker/docker/client"
+    "github.com/docker/go-connections/sockets"
+)
+
+var (
+    hostMu     sync.Mutex
+    dockerHost string
+    // transport of the shared client, kept to drop its idle connections
+    // on reload.
+    transport *http.Transport
+    sharedCli atomic.Pointer[client.Client]
+)
+
+// InitDocker creates the client shared by all handlers. The API version
+// is negotiated once here instead of on every request.
 func InitDocker(host string) {
+    cli, t, err := newDockerClient(host)
+    if err != nil {
+        logging.Fatal("docker: invalid host", "host", host, "error", err)
+    }
+    hostMu.Lock()
     dockerHost = host
+    transport = t
+    hostMu.Unlock()
+    sharedCli.Store(cli)
+}
+
+// PrepareReload builds a client for host. The returned apply switches
+// the shared client to it; requests already running keep the client they
+// started with. Reloads must not run concurrently.
+func PrepareReload(host string) (apply func(), err error) {
+    hostMu.Lock()
+    same := host == dockerHost
+    hostMu.Unlock()
+    if same {
+        return func() {}, nil
+    }
+    cli, t, err := newDockerClient(host)
+    if err != nil {
+        return nil, err
+    }
+    return func() {
+        hostMu.Lock()
+        defer hostMu.Unlock()
+        dockerHost = host
+        sharedCli.Store(cli)
+        if transport != nil {
+            // Only idle connections are dropped; in-flight calls finish.
+            transport.CloseIdleConnections()
+        }
+        transport = t
+    }, nil
+}
+
+// Ping checks that the daemon at the configured host answers.
+func Ping(ctx context.Context) error {
+    _, err := dockerClient().Ping(ctx)
+    return err
+}
+
+// ValidateHost reports whether host is a usable Docker host URL.
+func ValidateHost(host string) error {
+    _, err := client.ParseHostURL(host)
+    return err
+}
+
+func newDockerClient(host string) (*client.Client, *http.Transport, error) {
+    hostURL, err := client.ParseHostURL(host)
+    if err != nil {
+        return nil, nil, err
+    }
+    // Same pool settings as the SDK default; wrapped so every Engine API
+    // call is counted for /metrics.
+    t := &http.Transport{MaxIdleConns: 6, IdleConnTimeout: 30 * time.Second}
+    if err := sockets.ConfigureTransport(t, hostURL.Scheme, hostURL.Host); err != nil {
+        return nil, nil, err
+    }
+    cli, err := client.NewClientWithOpts(
+        client.WithHost(host),
+        client.WithHTTPClient(&http.Client{
+            Transport:     &instrumentedTransport{base: t},
+            CheckRedirect: client.CheckRedirect,
+        }),
+        client.WithAPIVersionNegotiation(),
+    )
+    if err != nil {
+        return nil, nil, err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if _, err := cli.Ping(ctx); err != nil {
+        slog.Warn("docker: daemon is not reachable", "host", host, "error", err)
+    } else {
+        cli.NegotiateAPIVersion(ctx)
+        slog.Info("docker: connected", "host", host, "api_version", cli.ClientVersion())
+    }
+    return cli, t, nil
+}
+
+func dockerClient() *client.Client {
+    return sharedCli.Load()
 }
@@ -3,17 +3,21 @@ package docker
 import (
     "context"
     "encoding/json"
+    "fmt"
     "net/http"
     "runtime"
     "strings"
     "sync"
     "time"
 
+    "agent/response"
+    "agent/server"
+
     "github.com/docker/docker/api/types"
     "github.com/docker/docker/api/types/container"
     "github.com/docker/docker/api/types/mount"
     "github.com/docker/docker/api/types/network"
-    "github.com/docker/docker/client"
+    "github.com/docker/go-connections/nat"
 )
 
 var (
@@ -28,6 +32,9 @@ type containerStats struct {
     MemoryLimit uint64
     NetworkRx uint64
     NetworkTx uint64
+    BlockRead  uint64
+    BlockWrite uint64
+    Interfaces map[string]container.NetworkStats
     Timestamp time.Time
 }
 
@@ -39,6 +46,11 @@ type ActionRequest struct {
     ID string `json:"id"`
 }
 
+type CreateContainerResponse struct {
+    Status string `json:"status"`
+    ID     string `json:"id"`
+}
+
 type CreateContainerRequest struct {
     Image   string                 `json:"image"`
     Name    string                 `json:"name"`
@@ -46,16 +58,59 @@ type CreateContainerRequest struct {
     Labels  map[string]string      `json:"labels"`
     IPv4    string                 `json:"ipv4"`
     IPv6    string                 `json:"ipv6"`
+    // Networks takes precedence over IPv4/IPv6, which only apply to
+    // the default bridge.
+    Networks []NetworkAttachment `json:"networks"`
+
+    Env        []string `json:"env"`
+    Cmd        []string `json:"cmd"`
+    Entrypoint []string `json:"entrypoint"`
+    WorkingDir string   `json:"working_dir"`
+    User       string   `json:"user"`
+    Hostname   string   `json:"hostname"`
+
+    ExposedPorts []string      `json:"exposed_ports"`
+    Ports        []PortMapping `json:"ports"`
+
+    RestartPolicy *RestartPolicySpec `json:"restart_policy"`
+    NanoCPUs      int64              `json:"nano_cpus"`
+    Memory        int64              `json:"memory"`
+    MemorySwap    int64              `json:"memory_swap"`
+    PidsLimit     *int64             `json:"pids_limit"`
+
+    Healthcheck    *HealthcheckSpec `json:"healthcheck"`
+    ExtraHosts     []string         `json:"extra_hosts"`
+    DNS            []string         `json:"dns"`
+    CapAdd         []string         `json:"cap_add"`
+    CapDrop        []string         `json:"cap_drop"`
+    ReadOnlyRootfs bool             `json:"read_only_rootfs"`
 }
 
-func ListContainers() ([]types.Container, error) {
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        return nil, err
-    }
-    defer cli.Close()
+// PortMapping publishes ContainerPort ("80" or "53/udp") on the host.
+// An empty HostPort lets the daemon pick one.
+type PortMapping struct {
+    ContainerPort string `json:"container_port"`
+    HostIP        string `json:"host_ip"`
+    HostPort      string `json:"host_port"`
+}
+
+type RestartPolicySpec struct {
+    Name              string `json:"name"`
+    MaximumRetryCount int    `json:"max_retries"`
+}
 
-    containers, err := cli.ContainerList(context.Background(), container.ListOptions{All: true})
+// HealthcheckSpec durations use Go duration syntax, e.g. "30s".
+type HealthcheckSpec struct {
+    Test          []string `json:"test"`
+    Interval      string   `json:"interval"`
+    Timeout       string   `json:"timeout"`
+    StartPeriod   string   `json:"start_period"`
+    StartInterval string   `json:"start_interval"`
+    Retries       int      `json:"retries"`
+}
+
+func ListContainers(ctx context.Context) ([]types.Container, error) {
+    containers, err := dockerClient().ContainerList(ctx, container.ListOptions{All: true})
     if err != nil {
         return nil, err
     }
@@ -63,31 +118,24 @@ func ListContainers() ([]types.Container, error) {
 }
 
 func ListContainersHandler(w http.ResponseWriter, r *http.Request) {
-    containers, err := ListContainers()
+    containers, err := ListContainers(r.Context())
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        response.FromError(w, err)
         return
     }
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(containers)
+    response.OK(w, containers)
 }
 
 func DeleteContainerHandler(w http.ResponseWriter, r *http.Request) {
     var req DeleteRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Missing or invalid container id"})
+    err := server.DecodeJSON(r, &req)
+    req.ID = server.PathOr(r, "id", req.ID)
+    if err != nil || req.ID == "" {
+        response.BadRequest(w, "Missing or invalid container id")
         return
     }
 
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-        return
-    }
-    defer cli.Close()
+    cli := dockerClient()
 
     opts := container.RemoveOptions{
         RemoveVolumes: false,
@@ -95,101 +143,70 @@ func DeleteContainerHandler(w http.ResponseWriter, r *http.Request) {
         Force:         true,
     }
 
-    err = cli.ContainerRemove(context.Background(), req.ID, opts)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+    if err := cli.ContainerRemove(r.Context(), req.ID, opts); err != nil {
+        response.FromError(w, err)
         return
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "Container deleted"})
+    response.OK(w, response.Message{Message: "Container deleted"})
 }
 
 func StopContainerHandler(w http.ResponseWriter, r *http.Request) {
     var req ActionRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Missing or invalid container id"})
-        return
-    }
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+    err := server.DecodeJSON(r, &req)
+    req.ID = server.PathOr(r, "id", req.ID)
+    if err != nil || req.ID == "" {
+        response.BadRequest(w, "Missing or invalid container id")
         return
     }
-    defer cli.Close()
-    if err := cli.ContainerStop(context.Background(), req.ID, container.StopOptions{}); err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+    cli := dockerClient()
+    if err := cli.ContainerStop(r.Context(), req.ID, container.StopOptions{}); err != nil {
+        response.FromError(w, err)
         return
     }
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "Container stopped"})
+    response.OK(w, response.Message{Message: "Container stopped"})
 }
 
 func StartContainerHandler(w http.ResponseWriter, r *http.Request) {
     var req ActionRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Missing or invalid container id"})
+    err := server.DecodeJSON(r, &req)
+    req.ID = server.PathOr(r, "id", req.ID)
+    if err != nil || req.ID == "" {
+        response.BadRequest(w, "Missing or invalid container id")
         return
     }
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-        return
-    }
-    defer cli.Close()
-    if err := cli.ContainerStart(context.Background(), req.ID, container.StartOptions{}); err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+    cli := dockerClient()
+    if err := cli.ContainerStart(r.Context(), req.ID, container.StartOptions{}); err != nil {
+        response.FromError(w, err)
         return
     }
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "Container started"})
+    response.OK(w, response.Message{Message: "Container started"})
 }
 
 func KillContainerHandler(w http.ResponseWriter, r *http.Request) {
     var req ActionRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Missing or invalid container id"})
-        return
-    }
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+    err := server.DecodeJSON(r, &req)
+    req.ID = server.PathOr(r, "id", req.ID)
+    if err != nil || req.ID == "" {
+        response.BadRequest(w, "Missing or invalid container id")
         return
     }
-    defer cli.Close()
-    if err := cli.ContainerKill(context.Background(), req.ID, "SIGKILL"); err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+    cli := dockerClient()
+    if err := cli.ContainerKill(r.Context(), req.ID, "SIGKILL"); err != nil {
+        response.FromError(w, err)
         return
     }
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "Container killed"})
+    response.OK(w, response.Message{Message: "Container killed"})
 }
 
 func CreateContainerHandler(w http.ResponseWriter, r *http.Request) {
     var req CreateContainerRequest
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+        response.BadRequest(w, "Invalid request")
         return
     }
 
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-        return
-    }
-    defer cli.Close()
+    cli := dockerClient()
 
     var mounts []mount.Mount
     for _, v := range req.Volumes {
@@ -208,77 +225,167 @@ func CreateContainerHandler(w http.ResponseWriter, r *http.Request) {
 
     networkingConfig := &network.NetworkingConfig{}
     endpointsConfig := make(map[string]*network.EndpointSettings)
-    ipamConfig := &network.EndpointIPAMConfig{}
-    if req.IPv4 != "" {
-        ipamConfig.IPv4Address = req.IPv4
+    for _, n := range req.Networks {
+        if n.Name == "" {
+            response.BadRequest(w, "Missing network name")
+            return
+        }
+        endpointsConfig[n.Name] = endpointSettings(n)
     }
-    if req.IPv6 != "" {
-        ipamConfig.IPv6Address = req.IPv6
+    if len(endpointsConfig) == 0 && (req.IPv4 != "" || req.IPv6 != "") {
+        endpointsConfig["bridge"] = endpointSettings(NetworkAttachment{IPv4: req.IPv4, IPv6: req.IPv6})
     }
-    if req.IPv4 != "" || req.IPv6 != "" {
-        endpointsConfig["bridge"] = &network.EndpointSettings{
-            IPAMConfig: ipamConfig,
-        }
+    if len(endpointsConfig) > 0 {
         networkingConfig.EndpointsConfig = endpointsConfig
     }
 
+    config, hostConfig, err := buildContainerConfig(req)
+    if err != nil {
+        response.BadRequest(w, err.Error())
+        return
+    }
+    hostConfig.Mounts = mounts
+
     resp, err := cli.ContainerCreate(
-        context.Background(),
-        &container.Config{
-            Image:  req.Image,
-            Labels: req.Labels,
-        },
-        &container.HostConfig{
-            Mounts: mounts,
-        },
+        r.Context(),
+        config,
+        hostConfig,
         networkingConfig,
         nil,
         req.Name,
     )
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        response.FromError(w, err)
         return
     }
 
-    if err := cli.ContainerStart(context.Background(), resp.ID, container.StartOptions{}); err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+    if err := cli.ContainerStart(r.Context(), resp.ID, container.StartOptions{}); err != nil {
+        response.FromError(w, err)
         return
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "status": "started",
-        "id":     resp.ID,
-    })
+    response.OK(w, CreateContainerResponse{Status: "started", ID: resp.ID})
+}
+
+func buildContainerConfig(req CreateContainerRequest) (*container.Config, *container.HostConfig, error) {
+    config := &container.Config{
+        Image:      req.Image,
+        Labels:     req.Labels,
+        Env:        req.Env,
+        Cmd:        req.Cmd,
+        Entrypoint: req.Entrypoint,
+        WorkingDir: req.WorkingDir,
+        User:       req.User,
+        Hostname:   req.Hostname,
+    }
+    hostConfig := &container.HostConfig{
+        ExtraHosts:     req.ExtraHosts,
+        DNS:            req.DNS,
+        CapAdd:         req.CapAdd,
+        CapDrop:        req.CapDrop,
+        ReadonlyRootfs: req.ReadOnlyRootfs,
+        Resources: container.Resources{
+            NanoCPUs:   req.NanoCPUs,
+            Memory:     req.Memory,
+            MemorySwap: req.MemorySwap,
+            PidsLimit:  req.PidsLimit,
+        },
+    }
+
+    exposed := nat.PortSet{}
+    for _, p := range req.ExposedPorts {
+        port, err := parsePort(p)
+        if err != nil {
+            return nil, nil, err
+        }
+        exposed[port] = struct{}{}
+    }
+    bindings := nat.PortMap{}
+    for _, m := range req.Ports {
+        port, err := parsePort(m.ContainerPort)
+        if err != nil {
+            return nil, nil, err
+        }
+        exposed[port] = struct{}{}
+        bindings[port] = append(bindings[port], nat.PortBinding{HostIP: m.HostIP, HostPort: m.HostPort})
+    }
+    if len(exposed) > 0 {
+        config.ExposedPorts = exposed
+    }
+    if len(bindings) > 0 {
+        hostConfig.PortBindings = bindings
+    }
+
+    if req.RestartPolicy != nil {
+        policy := container.RestartPolicy{
+            Name:              container.RestartPolicyMode(req.RestartPolicy.Name),
+            MaximumRetryCount: req.RestartPolicy.MaximumRetryCount,
+        }
+        if err := container.ValidateRestartPolicy(policy); err != nil {
+            return nil, nil, err
+        }
+        hostConfig.RestartPolicy = policy
+    }
+
+    if req.Healthcheck != nil {
+        hc := &container.HealthConfig{
+            Test:    req.Healthcheck.Test,
+            Retries: req.Healthcheck.Retries,
+        }
+        durations := []struct {
+            value  string
+            target *time.Duration
+            field  string
+        }{
+            {req.Healthcheck.Interval, &hc.Interval, "interval"},
+            {req.Healthcheck.Timeout, &hc.Timeout, "timeout"},
+            {req.Healthcheck.StartPeriod, &hc.StartPeriod, "start_period"},
+            {req.Healthcheck.StartInterval, &hc.StartInterval, "start_interval"},
+        }
+        for _, d := range durations {
+            if d.value == "" {
+                continue
+            }
+            parsed, err := time.ParseDuration(d.value)
+            if err != nil {
+                return nil, nil, fmt.Errorf("invalid healthcheck %s: %v", d.field, err)
+            }
+            *d.target = parsed
+        }
+        config.Healthcheck = hc
+    }
+
+    return config, hostConfig, nil
+}
+
+// parsePort accepts "80" or "80/udp"; the protocol defaults to tcp.
+func parsePort(spec string) (nat.Port, error) {
+    proto, port := nat.SplitProtoPort(spec)
+    if port == "" {
+        return "", fmt.Errorf("invalid port: %q", spec)
+    }
+    if _, err := nat.ParsePort(port); err != nil {
+        return "", fmt.Errorf("invalid port: %q", spec)
+    }
+    return nat.NewPort(proto, port)
 }
 
 func GetContainerByIDHandler(w http.ResponseWriter, r *http.Request) {
-    id := r.URL.Query().Get("id")
+    id := server.PathOr(r, "id", r.URL.Query().Get("id"))
     if id == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Missing container id"})
+        response.BadRequest(w, "Missing container id")
         return
     }
 
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-        return
-    }
-    defer cli.Close()
+    cli := dockerClient()
 
-    containerJSON, err := cli.ContainerInspect(context.Background(), id)
+    containerJSON, err := cli.ContainerInspect(r.Context(), id)
     if err != nil {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        response.FromError(w, err)
         return
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(containerJSON)
+    response.OK(w, containerJSON)
 }
 
 func GetContainerByNameHandler(w http.ResponseWriter, r *http.Request) {
@@ -296,44 +403,33 @@ func GetContainerByNameHandler(w http.ResponseWriter, r *http.Request) {
     }
 
     if name == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Missing container name"})
+        response.BadRequest(w, "Missing container name")
         return
     }
 
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-        return
-    }
-    defer cli.Close()
+    cli := dockerClient()
 
-    containers, err := cli.ContainerList(context.Background(), container.ListOptions{All: true})
+    containers, err := cli.ContainerList(r.Context(), container.ListOptions{All: true})
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        response.FromError(w, err)
         return
     }
 
     for _, c := range containers {
         for _, n := range c.Names {
             if strings.TrimPrefix(n, "/") == name {
-                containerJSON, err := cli.ContainerInspect(context.Background(), c.ID)
+                containerJSON, err := cli.ContainerInspect(r.Context(), c.ID)
                 if err != nil {
-                    w.WriteHeader(http.StatusNotFound)
-                    json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+                    response.FromError(w, err)
                     return
                 }
-                w.Header().Set("Content-Type", "application/json")
-                json.NewEncoder(w).Encode(containerJSON)
+                response.OK(w, containerJSON)
                 return
             }
         }
     }
 
-    w.WriteHeader(http.StatusNotFound)
-    json.NewEncoder(w).Encode(map[string]string{"error": "Container not found"})
+    response.Fail(w, http.StatusNotFound, response.CodeNotFound, "Container not found")
 }
 
 func GetContainerStatsByNameHandler(w http.ResponseWriter, r *http.Request) {
@@ -349,24 +445,16 @@ func GetContainerStatsByNameHandler(w http.ResponseWriter, r *http.Request) {
         }
     }
     if name == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Missing container name"})
+        response.BadRequest(w, "Missing container name")
         return
     }
 
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-        return
-    }
-    defer cli.Close()
+    cli := dockerClient()
 
     containerID := ""
-    containers, err := cli.ContainerList(context.Background(), container.ListOptions{All: true})
+    containers, err := cli.ContainerList(r.Context(), container.ListOptions{All: true})
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        response.FromError(w, err)
         return
     }
 
@@ -380,61 +468,49 @@ func GetContainerStatsByNameHandler(w http.ResponseWriter, r *http.Request) {
     }
 
     if containerID == "" {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Container not found"})
+        response.Fail(w, http.StatusNotFound, response.CodeNotFound, "Container not found")
         return
     }
 
-    containerInfo, err := cli.ContainerInspect(context.Background(), containerID)
+    containerInfo, err := cli.ContainerInspect(r.Context(), containerID)
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        response.FromError(w, err)
         return
     }
+    writeStatsSnapshot(w, r, containerInfo)
+}
 
-    statsResp, err := cli.ContainerStatsOneShot(context.Background(), containerID)
+// ContainerSnapshotHandler returns a one-shot stats snapshot for the {id}
+// path value, which may be a container id or name.
+func ContainerSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+    containerInfo, err := dockerClient().ContainerInspect(r.Context(), r.PathValue("id"))
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        response.FromError(w, err)
+        return
+    }
+    writeStatsSnapshot(w, r, containerInfo)
+}
+
+func writeStatsSnapshot(w http.ResponseWriter, r *http.Request, info container.InspectResponse) {
+    statsResp, err := dockerClient().ContainerStatsOneShot(r.Context(), info.ID)
+    if err != nil {
+        response.FromError(w, err)
         return
     }
     defer statsResp.Body.Close()
 
     var stats container.Stats
     if err := json.NewDecoder(statsResp.Body).Decode(&stats); err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        response.FromError(w, err)
         return
     }
 
-    hostCPUs := len(stats.CPUStats.CPUUsage.PercpuUsage)
-    if hostCPUs == 0 {
-        hostCPUs = runtime.NumCPU()
-    }
-
-    cpuPercent := calculateCPUPercentage(containerID, stats)
-    memUsage := float64(stats.MemoryStats.Usage) / (1024 * 1024)
-    memLimit := float64(stats.MemoryStats.Limit) / (1024 * 1024)
-    networkRx, networkTx := calculateNetworkUsage(containerID, stats)
-    cpuLimitPercent := float64(hostCPUs * 100)
-    if containerInfo.HostConfig.NanoCPUs > 0 {
-        cpuLimitPercent = float64(containerInfo.HostConfig.NanoCPUs) / 10000000
-    } else if containerInfo.HostConfig.CPUQuota > 0 && containerInfo.HostConfig.CPUPeriod > 0 {
-        cpuLimitPercent = float64(containerInfo.HostConfig.CPUQuota) / float64(containerInfo.HostConfig.CPUPeriod) * 100
-    }
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "cpu_percent": cpuPercent,
-        "cpu_limit_percent": cpuLimitPercent,
-        "mem_usage_mb": memUsage,
-        "mem_limit_mb": memLimit,
-        "network_rx_bytes": networkRx,
-        "network_tx_bytes": networkTx,
-        "host_cpus": hostCPUs,
-    })
+    response.OK(w, buildStatsSnapshot(info.ID, strings.TrimPrefix(info.Name, "/"), info.HostConfig, stats))
 }
 
-func calculateCPUPercentage(containerID string, stats container.Stats) float64 {
+// updateStatsCache stores the sample for containerID and returns it with
+// the previous one. previous is nil when there is no usable history.
+func updateStatsCache(containerID string, stats container.Stats) (*containerStats, *containerStats) {
     statsMutex.Lock()
     defer statsMutex.Unlock()
 
@@ -444,6 +520,7 @@ func calculateCPUPercentage(containerID string, stats container.Stats) float64 {
         SystemUsage: stats.CPUStats.SystemUsage,
         MemoryUsage: stats.MemoryStats.Usage,
         MemoryLimit: stats.MemoryStats.Limit,
+        Interfaces:  stats.Networks,
         Timestamp:   now,
     }
 
@@ -453,11 +530,19 @@ func calculateCPUPercentage(containerID string, stats container.Stats) float64 {
             currentStats.NetworkTx += network.TxBytes
         }
     }
+    currentStats.BlockRead, currentStats.BlockWrite = sumBlkio(stats.BlkioStats.IoServiceBytesRecursive)
 
     previousStats, exists := statsCache[containerID]
     statsCache[containerID] = currentStats
 
     if !exists || now.Sub(previousStats.Timestamp) > 30*time.Second {
+        return currentStats, nil
+    }
+    return currentStats, previousStats
+}
+
+func calculateCPUPercentage(stats container.Stats, currentStats, previousStats *containerStats) float64 {
+    if previousStats == nil {
         numCPUs := len(stats.CPUStats.CPUUsage.PercpuUsage)
         if numCPUs == 0 {
             numCPUs = runtime.NumCPU()
@@ -468,8 +553,8 @@ func calculateCPUPercentage(containerID string, stats container.Stats) float64 {
         }
         return 0.0
     }
-    cpuDelta := float64(currentStats.CPUUsage - previousStats.CPUUsage)
-    systemDelta := float64(currentStats.SystemUsage - previousStats.SystemUsage)
+    cpuDelta := float64(currentStats.CPUUsage) - float64(previousStats.CPUUsage)
+    systemDelta := float64(currentStats.SystemUsage) - float64(previousStats.SystemUsage)
     if systemDelta > 0 && cpuDelta > 0 {
         numCPUs := len(stats.CPUStats.CPUUsage.PercpuUsage)
         if numCPUs == 0 {
@@ -479,16 +564,51 @@ func calculateCPUPercentage(containerID string, stats container.Stats) float64 {
     }
     return 0.0
 }
-func calculateNetworkUsage(containerID string, stats container.Stats) (uint64, uint64) {
-    rx := uint64(0)
-    tx := uint64(0)
 
-    if stats.Networks != nil {
-        for _, network := range stats.Networks {
-            rx += network.RxBytes
-            tx += network.TxBytes
+// calculateNetworkUsage returns the summed rx/tx totals and per-second
+// rates against the previous sample.
+func calculateNetworkUsage(currentStats, previousStats *containerStats) (uint64, uint64, float64, float64) {
+    if previousStats == nil {
+        return currentStats.NetworkRx, currentStats.NetworkTx, 0, 0
+    }
+    seconds := currentStats.Timestamp.Sub(previousStats.Timestamp).Seconds()
+    return currentStats.NetworkRx, currentStats.NetworkTx,
+        ratePerSecond(currentStats.NetworkRx, previousStats.NetworkRx, seconds),
+        ratePerSecond(currentStats.NetworkTx, previousStats.NetworkTx, seconds)
+}
+
+// calculateMemoryUsage subtracts inactive page cache from the raw usage
+// the same way `docker stats` does, for both cgroup v1 and v2.
+func calculateMemoryUsage(stats container.MemoryStats) (uint64, uint64) {
+    cache, ok := stats.Stats["total_inactive_file"]
+    if !ok {
+        cache = stats.Stats["inactive_file"]
+    }
+    if cache > stats.Usage {
+        return 0, cache
+    }
+    return stats.Usage - cache, cache
+}
+
+func sumBlkio(entries []container.BlkioStatEntry) (uint64, uint64) {
+    read := uint64(0)
+    write := uint64(0)
+    for _, e := range entries {
+        switch strings.ToLower(e.Op) {
+        case "read":
+            read += e.Value
+        case "write":
+            write += e.Value
         }
     }
+    return read, write
+}
 
-    return rx, tx
+// ratePerSecond treats a counter that went backwards (container restart)
+// as having no rate.
+func ratePerSecond(current, previous uint64, seconds float64) float64 {
+    if seconds <= 0 || current < previous {
+        return 0
+    }
+    return float64(current-previous) / seconds
 }
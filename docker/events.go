@@ -0,0 +1,433 @@
+package docker
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "agent/response"
+    "agent/server"
+
+    "github.com/docker/docker/api/types/events"
+    "github.com/docker/docker/api/types/filters"
+    "github.com/gorilla/websocket"
+)
+
+// Event types the relay subscribes to.
+var eventTypes = []string{"container", "image", "network", "volume"}
+
+const (
+    // Events kept for clients resuming with since or Last-Event-ID.
+    eventBufferSize = 1024
+    // A subscriber that falls this far behind is dropped and has to
+    // resume.
+    subscriberQueue = 256
+    eventKeepalive  = 30 * time.Second
+    // Clients only send control frames.
+    eventsReadLimit = 4 << 10
+)
+
+type EventsConfig struct {
+    Webhook WebhookConfig `json:"webhook"`
+}
+
+// Event is a Docker engine event as relayed to clients. Attributes holds
+// the actor's attributes; for containers these include its labels, name
+// and image, and exitCode on die.
+type Event struct {
+    Type       string            `json:"type"`
+    Action     string            `json:"action"`
+    ID         string            `json:"id"`
+    Attributes map[string]string `json:"attributes,omitempty"`
+    Time       time.Time         `json:"time"`
+    TimeNano   int64             `json:"time_nano"`
+}
+
+var relay = &eventRelay{subs: make(map[*eventSubscriber]struct{})}
+
+// eventRelay follows the daemon's event stream once and fans it out to
+// every subscriber.
+type eventRelay struct {
+    mu       sync.Mutex
+    buffer   []Event
+    lastNano int64
+    subs     map[*eventSubscriber]struct{}
+}
+
+type eventSubscriber struct {
+    ch chan Event
+    // dropped is set when the subscriber could not keep up and ch was
+    // closed.
+    dropped bool
+}
+
+// StartEventRelay follows Docker events until ctx is cancelled and, when
+// a webhook URL is configured, delivers them to it.
+func StartEventRelay(ctx context.Context, cfg EventsConfig) error {
+    if cfg.Webhook.URL != "" {
+        wh, err := newWebhook(cfg.Webhook)
+        if err != nil {
+            return err
+        }
+        go wh.run(ctx)
+    }
+    go relay.run(ctx)
+    return nil
+}
+
+func (r *eventRelay) run(ctx context.Context) {
+    backoff := time.Second
+    for {
+        started := time.Now()
+        err := r.follow(ctx)
+        if ctx.Err() != nil {
+            return
+        }
+        if time.Since(started) > time.Minute {
+            backoff = time.Second
+        }
+        if err != nil {
+            slog.Warn("docker: event stream interrupted", "error", err, "retry_in", backoff.String())
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(backoff):
+        }
+        backoff = min(2*backoff, 30*time.Second)
+    }
+}
+
+// follow reads one event stream. It resumes after the last relayed event
+// so a reconnect does not lose any, and returns when the shared client
+// is replaced by a reload.
+func (r *eventRelay) follow(ctx context.Context) error {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    args := filters.NewArgs()
+    for _, t := range eventTypes {
+        args.Add("type", t)
+    }
+    opts := events.ListOptions{Filters: args}
+    r.mu.Lock()
+    last := r.lastNano
+    r.mu.Unlock()
+    if last > 0 {
+        opts.Since = fmt.Sprintf("%d.%09d", last/int64(time.Second), last%int64(time.Second))
+    }
+
+    cli := dockerClient()
+    msgs, errs := cli.Events(ctx, opts)
+    check := time.NewTicker(5 * time.Second)
+    defer check.Stop()
+    for {
+        select {
+        case m := <-msgs:
+            r.publish(Event{
+                Type:       string(m.Type),
+                Action:     string(m.Action),
+                ID:         m.Actor.ID,
+                Attributes: m.Actor.Attributes,
+                Time:       time.Unix(0, m.TimeNano).UTC(),
+                TimeNano:   m.TimeNano,
+            })
+        case err := <-errs:
+            return err
+        case <-check.C:
+            if dockerClient() != cli {
+                return nil
+            }
+        case <-ctx.Done():
+            return nil
+        }
+    }
+}
+
+func (r *eventRelay) publish(e Event) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    // A resumed stream starts at the last event again.
+    if e.TimeNano <= r.lastNano {
+        return
+    }
+    r.lastNano = e.TimeNano
+    if len(r.buffer) == eventBufferSize {
+        r.buffer = append(r.buffer[:0], r.buffer[1:]...)
+    }
+    r.buffer = append(r.buffer, e)
+    for sub := range r.subs {
+        select {
+        case sub.ch <- e:
+        default:
+            sub.dropped = true
+            close(sub.ch)
+            delete(r.subs, sub)
+        }
+    }
+}
+
+// subscribe returns the buffered events newer than since (none when
+// since is zero) and a subscription for everything after them.
+func (r *eventRelay) subscribe(since int64, queue int) ([]Event, *eventSubscriber) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    var replay []Event
+    if since > 0 {
+        for _, e := range r.buffer {
+            if e.TimeNano > since {
+                replay = append(replay, e)
+            }
+        }
+    }
+    sub := &eventSubscriber{ch: make(chan Event, queue)}
+    r.subs[sub] = struct{}{}
+    return replay, sub
+}
+
+func (r *eventRelay) unsubscribe(sub *eventSubscriber) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, ok := r.subs[sub]; ok {
+        delete(r.subs, sub)
+        close(sub.ch)
+    }
+}
+
+func (r *eventRelay) wasDropped(sub *eventSubscriber) bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return sub.dropped
+}
+
+// eventFilter selects events by type and label. Labels are "key" or
+// "key=value" and must all match.
+type eventFilter struct {
+    types  map[string]bool
+    labels []string
+}
+
+func parseEventFilter(types, labels []string) (eventFilter, error) {
+    f := eventFilter{}
+    for _, list := range types {
+        for _, t := range strings.Split(list, ",") {
+            t = strings.TrimSpace(t)
+            if t == "" {
+                continue
+            }
+            known := false
+            for _, et := range eventTypes {
+                known = known || t == et
+            }
+            if !known {
+                return eventFilter{}, fmt.Errorf("Unknown event type %q; use one of %s", t, strings.Join(eventTypes, ", "))
+            }
+            if f.types == nil {
+                f.types = make(map[string]bool)
+            }
+            f.types[t] = true
+        }
+    }
+    for _, l := range labels {
+        if l = strings.TrimSpace(l); l != "" {
+            f.labels = append(f.labels, l)
+        }
+    }
+    return f, nil
+}
+
+func (f eventFilter) match(e Event) bool {
+    if f.types != nil && !f.types[e.Type] {
+        return false
+    }
+    for _, l := range f.labels {
+        key, value, hasValue := strings.Cut(l, "=")
+        got, ok := e.Attributes[key]
+        if !ok || hasValue && got != value {
+            return false
+        }
+    }
+    return true
+}
+
+// parseEventSince accepts RFC 3339 or Unix seconds with an optional
+// fraction, like the Docker CLI.
+func parseEventSince(v string) (int64, error) {
+    if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+        return t.UnixNano(), nil
+    }
+    sec, frac, _ := strings.Cut(v, ".")
+    s, err := strconv.ParseInt(sec, 10, 64)
+    if err != nil {
+        return 0, errors.New("Invalid since: expected RFC 3339 time or Unix seconds")
+    }
+    var nanos int64
+    if frac != "" {
+        frac = (frac + "000000000")[:9]
+        if nanos, err = strconv.ParseInt(frac, 10, 64); err != nil {
+            return 0, errors.New("Invalid since: expected RFC 3339 time or Unix seconds")
+        }
+    }
+    return s*int64(time.Second) + nanos, nil
+}
+
+// EventsHandler relays Docker events as server-sent events, or over a
+// WebSocket when the request asks for an upgrade. Query parameters: type
+// and label (repeatable) and since to replay buffered events first. SSE
+// clients can resume with Last-Event-ID instead of since.
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    filter, err := parseEventFilter(q["type"], q["label"])
+    if err != nil {
+        response.BadRequest(w, err.Error())
+        return
+    }
+    var since int64
+    if v := q.Get("since"); v != "" {
+        if since, err = parseEventSince(v); err != nil {
+            response.BadRequest(w, err.Error())
+            return
+        }
+    } else if v := r.Header.Get("Last-Event-ID"); v != "" {
+        since, _ = strconv.ParseInt(v, 10, 64)
+    }
+
+    ctx, cancel := server.StreamContext(r.Context())
+    defer cancel()
+
+    replay, sub := relay.subscribe(since, subscriberQueue)
+    defer relay.unsubscribe(sub)
+
+    if websocket.IsWebSocketUpgrade(r) {
+        serveEventsWS(ctx, w, r, filter, replay, sub)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("X-Accel-Buffering", "no")
+    http.NewResponseController(w).SetWriteDeadline(time.Time{})
+    w.WriteHeader(http.StatusOK)
+    flusher, _ := w.(http.Flusher)
+    flush := func() {
+        if flusher != nil {
+            flusher.Flush()
+        }
+    }
+    send := func(e Event) error {
+        if !filter.match(e) {
+            return nil
+        }
+        data, err := json.Marshal(e)
+        if err != nil {
+            return err
+        }
+        if _, err := fmt.Fprintf(w, "id: %d\n", e.TimeNano); err != nil {
+            return err
+        }
+        return writeSSE(w, e.Type, string(data))
+    }
+
+    for _, e := range replay {
+        if err := send(e); err != nil {
+            return
+        }
+    }
+    flush()
+
+    keepalive := time.NewTicker(eventKeepalive)
+    defer keepalive.Stop()
+    for {
+        select {
+        case e, ok := <-sub.ch:
+            if !ok {
+                if relay.wasDropped(sub) {
+                    writeSSE(w, "error", "client too slow; reconnect to resume")
+                    flush()
+                }
+                return
+            }
+            if err := send(e); err != nil {
+                return
+            }
+            flush()
+        case <-keepalive.C:
+            if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+                return
+            }
+            flush()
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+// serveEventsWS sends each event as a JSON text frame. Messages from the
+// client are ignored; reading only detects when it goes away.
+func serveEventsWS(ctx context.Context, w http.ResponseWriter, r *http.Request, filter eventFilter, replay []Event, sub *eventSubscriber) {
+    ws, err := wsUpgrader.Upgrade(w, r, nil)
+    if err != nil {
+        // Upgrade has already written the error response.
+        return
+    }
+    defer ws.Close()
+    ws.SetReadLimit(eventsReadLimit)
+
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    go func() {
+        defer cancel()
+        for {
+            if _, _, err := ws.ReadMessage(); err != nil {
+                return
+            }
+        }
+    }()
+
+    send := func(e Event) error {
+        if !filter.match(e) {
+            return nil
+        }
+        ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+        return ws.WriteJSON(e)
+    }
+    closeWS := func(code int, reason string) {
+        ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+    }
+
+    for _, e := range replay {
+        if err := send(e); err != nil {
+            return
+        }
+    }
+    keepalive := time.NewTicker(eventKeepalive)
+    defer keepalive.Stop()
+    for {
+        select {
+        case e, ok := <-sub.ch:
+            if !ok {
+                if relay.wasDropped(sub) {
+                    closeWS(websocket.CloseTryAgainLater, "client too slow; reconnect to resume")
+                }
+                return
+            }
+            if err := send(e); err != nil {
+                return
+            }
+        case <-keepalive.C:
+            if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+                return
+            }
+        case <-ctx.Done():
+            closeWS(websocket.CloseGoingAway, "agent shutting down")
+            return
+        }
+    }
+}
@@ -0,0 +1,245 @@
+package docker
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "agent/response"
+    "agent/server"
+
+    "github.com/docker/docker/api/types/container"
+    "github.com/gorilla/websocket"
+)
+
+type ExecConfig struct {
+    AllowedCommands []string `json:"allowed_commands"`
+    // AllowedUsers may be named in the user query parameter. Without it
+    // the command runs as the container's default user.
+    AllowedUsers []string `json:"allowed_users"`
+    IdleTimeout  string   `json:"idle_timeout"`
+}
+
+var (
+    execAllowed      = map[string]struct{}{"/bin/sh": {}, "/bin/bash": {}}
+    execAllowedUsers = map[string]struct{}{}
+    execIdleTimeout = 15 * time.Minute
+)
+
+// Largest frame a client may send: terminal input or a resize.
+const execReadLimit = 64 << 10
+
+var wsUpgrader = websocket.Upgrader{
+    ReadBufferSize:  4096,
+    WriteBufferSize: 4096,
+    CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin refuses cross-origin upgrades unless the request carries a
+// bearer token, which a foreign page cannot add on its own. Any other
+// credential a browser sends by itself would let that page open a socket
+// as the user.
+func checkOrigin(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    if origin == "" || r.Header.Get("Authorization") != "" {
+        return true
+    }
+    u, err := url.Parse(origin)
+    return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// execMessage is a text frame sent by the client. Binary frames are raw
+// terminal input.
+type execMessage struct {
+    Type string `json:"type"`
+    Data string `json:"data"`
+    Cols uint   `json:"cols"`
+    Rows uint   `json:"rows"`
+}
+
+func InitExec(cfg ExecConfig) {
+    if len(cfg.AllowedCommands) > 0 {
+        execAllowed = make(map[string]struct{})
+        for _, c := range cfg.AllowedCommands {
+            execAllowed[c] = struct{}{}
+        }
+    }
+    execAllowedUsers = make(map[string]struct{})
+    for _, u := range cfg.AllowedUsers {
+        execAllowedUsers[u] = struct{}{}
+    }
+    if cfg.IdleTimeout != "" {
+        if d, err := time.ParseDuration(cfg.IdleTimeout); err == nil && d > 0 {
+            execIdleTimeout = d
+        }
+    }
+}
+
+// ExecHandler opens an interactive TTY exec in a container and bridges it
+// to a WebSocket. Query parameters: id, cmd, user, cols, rows.
+func ExecHandler(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    id := server.PathOr(r, "id", q.Get("id"))
+    cmd := q.Get("cmd")
+    if cmd == "" {
+        cmd = "/bin/sh"
+    }
+    if id == "" {
+        response.BadRequest(w, "Missing container id")
+        return
+    }
+    if _, ok := execAllowed[cmd]; !ok {
+        response.Fail(w, http.StatusForbidden, response.CodeForbidden, "Command not allowed: "+cmd)
+        return
+    }
+    execUser := q.Get("user")
+    if _, ok := execAllowedUsers[execUser]; execUser != "" && !ok {
+        response.Fail(w, http.StatusForbidden, response.CodeForbidden, "User not allowed: "+execUser)
+        return
+    }
+    // Nothing is started in the container until the client has shown it
+    // can take the stream.
+    if !websocket.IsWebSocketUpgrade(r) {
+        response.BadRequest(w, "Exec requires a WebSocket upgrade")
+        return
+    }
+    if !checkOrigin(r) {
+        response.Fail(w, http.StatusForbidden, response.CodeForbidden, "Cross-origin exec requires an Authorization header")
+        return
+    }
+
+    var size *[2]uint
+    cols, _ := strconv.ParseUint(q.Get("cols"), 10, 16)
+    rows, _ := strconv.ParseUint(q.Get("rows"), 10, 16)
+    if cols > 0 && rows > 0 {
+        size = &[2]uint{uint(rows), uint(cols)}
+    }
+
+    ctx, cancel := server.StreamContext(r.Context())
+    defer cancel()
+
+    cli := dockerClient()
+    exec, err := cli.ContainerExecCreate(ctx, id, container.ExecOptions{
+        User:         execUser,
+        Tty:          true,
+        ConsoleSize:  size,
+        AttachStdin:  true,
+        AttachStdout: true,
+        AttachStderr: true,
+        Cmd:          []string{cmd},
+    })
+    if err != nil {
+        response.FromError(w, err)
+        return
+    }
+
+    hijacked, err := cli.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{Tty: true, ConsoleSize: size})
+    if err != nil {
+        response.FromError(w, err)
+        return
+    }
+    defer hijacked.Close()
+
+    ws, err := wsUpgrader.Upgrade(w, r, nil)
+    if err != nil {
+        // Upgrade has already written the error response.
+        return
+    }
+    defer ws.Close()
+    ws.SetReadLimit(execReadLimit)
+
+    var writeMu sync.Mutex
+    writeWS := func(messageType int, data []byte) error {
+        writeMu.Lock()
+        defer writeMu.Unlock()
+        ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+        return ws.WriteMessage(messageType, data)
+    }
+    closeWS := func(code int, reason string) {
+        writeMu.Lock()
+        defer writeMu.Unlock()
+        ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+    }
+
+    var lastActivity atomic.Int64
+    touch := func() { lastActivity.Store(time.Now().UnixNano()) }
+    touch()
+
+    // Container output -> WebSocket.
+    go func() {
+        defer cancel()
+        buf := make([]byte, 32*1024)
+        for {
+            n, err := hijacked.Reader.Read(buf)
+            if n > 0 {
+                touch()
+                if werr := writeWS(websocket.BinaryMessage, buf[:n]); werr != nil {
+                    return
+                }
+            }
+            if err != nil {
+                closeWS(websocket.CloseNormalClosure, "process exited")
+                return
+            }
+        }
+    }()
+
+    // Idle watchdog.
+    go func() {
+        ticker := time.NewTicker(time.Second * 5)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                if time.Since(time.Unix(0, lastActivity.Load())) > execIdleTimeout {
+                    closeWS(websocket.ClosePolicyViolation, "idle timeout")
+                    cancel()
+                    return
+                }
+            }
+        }
+    }()
+
+    // Closing the socket unblocks ReadMessage below once ctx is done.
+    go func() {
+        <-ctx.Done()
+        ws.Close()
+    }()
+
+    // WebSocket -> container input and control messages.
+    for {
+        messageType, data, err := ws.ReadMessage()
+        if err != nil {
+            return
+        }
+        touch()
+        switch messageType {
+        case websocket.BinaryMessage:
+            if _, err := hijacked.Conn.Write(data); err != nil {
+                return
+            }
+        case websocket.TextMessage:
+            var msg execMessage
+            if err := json.Unmarshal(data, &msg); err != nil {
+                continue
+            }
+            switch msg.Type {
+            case "input":
+                if _, err := hijacked.Conn.Write([]byte(msg.Data)); err != nil {
+                    return
+                }
+            case "resize":
+                if msg.Cols > 0 && msg.Rows > 0 {
+                    cli.ContainerExecResize(ctx, exec.ID, container.ResizeOptions{Height: msg.Rows, Width: msg.Cols})
+                }
+            }
+        }
+    }
+}
@@ -3,20 +3,36 @@ package docker
 import (
     "context"
     "encoding/json"
+    "io"
     "net/http"
+    "time"
+
+    "agent/response"
+    "agent/server"
 
     "github.com/docker/docker/api/types/image"
-    "github.com/docker/docker/client"
+    "github.com/docker/docker/api/types/registry"
+    "github.com/docker/docker/pkg/jsonmessage"
 )
 
-func ListImages() ([]image.Summary, error) {
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        return nil, err
-    }
-    defer cli.Close()
+type PullImageRequest struct {
+    Image         string `json:"image"`
+    Platform      string `json:"platform"`
+    Username      string `json:"username"`
+    Password      string `json:"password"`
+    ServerAddress string `json:"server_address"`
+}
 
-    images, err := cli.ImageList(context.Background(), image.ListOptions{All: true})
+type PullProgress struct {
+    ID      string `json:"id,omitempty"`
+    Status  string `json:"status,omitempty"`
+    Current int64  `json:"current,omitempty"`
+    Total   int64  `json:"total,omitempty"`
+    Error   string `json:"error,omitempty"`
+}
+
+func ListImages(ctx context.Context) ([]image.Summary, error) {
+    images, err := dockerClient().ImageList(ctx, image.ListOptions{All: true})
     if err != nil {
         return nil, err
     }
@@ -24,41 +40,102 @@ func ListImages() ([]image.Summary, error) {
 }
 
 func ListImagesHandler(w http.ResponseWriter, r *http.Request) {
-    images, err := ListImages()
+    images, err := ListImages(r.Context())
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        response.FromError(w, err)
         return
     }
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(images)
+    response.OK(w, images)
 }
 
 func DeleteImageHandler(w http.ResponseWriter, r *http.Request) {
     var req struct {
         Registry string `json:"registry"`
     }
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Registry == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Missing or invalid registry"})
+    err := server.DecodeJSON(r, &req)
+    req.Registry = server.PathOr(r, "ref", req.Registry)
+    if err != nil || req.Registry == "" {
+        response.BadRequest(w, "Missing or invalid registry")
         return
     }
 
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+    cli := dockerClient()
+
+    if _, err := cli.ImageRemove(r.Context(), req.Registry, image.RemoveOptions{Force: true, PruneChildren: true}); err != nil {
+        response.FromError(w, err)
         return
     }
-    defer cli.Close()
 
-    _, err = cli.ImageRemove(context.Background(), req.Registry, image.RemoveOptions{Force: true, PruneChildren: true})
+    response.OK(w, response.Message{Message: "Image deleted"})
+}
+
+// PullImageHandler pulls an image and streams the per-layer progress
+// reported by the daemon back to the caller as NDJSON.
+func PullImageHandler(w http.ResponseWriter, r *http.Request) {
+    var req PullImageRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Image == "" {
+        response.BadRequest(w, "Missing or invalid image")
+        return
+    }
+
+    opts := image.PullOptions{Platform: req.Platform}
+    if req.Username != "" || req.Password != "" {
+        auth, err := registry.EncodeAuthConfig(registry.AuthConfig{
+            Username:      req.Username,
+            Password:      req.Password,
+            ServerAddress: req.ServerAddress,
+        })
+        if err != nil {
+            response.BadRequest(w, err.Error())
+            return
+        }
+        opts.RegistryAuth = auth
+    }
+
+    cli := dockerClient()
+
+    body, err := cli.ImagePull(r.Context(), req.Image, opts)
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        response.FromError(w, err)
         return
     }
+    defer body.Close()
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "Image deleted"})
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    w.Header().Set("Cache-Control", "no-cache")
+    // Large pulls take longer than the server's write timeout.
+    http.NewResponseController(w).SetWriteDeadline(time.Time{})
+    w.WriteHeader(http.StatusOK)
+    flusher, _ := w.(http.Flusher)
+    enc := json.NewEncoder(w)
+
+    dec := json.NewDecoder(body)
+    for {
+        var msg jsonmessage.JSONMessage
+        if err := dec.Decode(&msg); err != nil {
+            if err != io.EOF {
+                enc.Encode(PullProgress{Error: err.Error()})
+                return
+            }
+            break
+        }
+        p := PullProgress{ID: msg.ID, Status: msg.Status}
+        if msg.Progress != nil {
+            p.Current = msg.Progress.Current
+            p.Total = msg.Progress.Total
+        }
+        if msg.Error != nil {
+            p.Error = msg.Error.Message
+        }
+        if err := enc.Encode(p); err != nil {
+            return
+        }
+        if flusher != nil {
+            flusher.Flush()
+        }
+        if msg.Error != nil {
+            return
+        }
+    }
+    enc.Encode(PullProgress{Status: "complete", ID: req.Image})
 }
@@ -0,0 +1,193 @@
+package docker
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "agent/response"
+    "agent/server"
+
+    "github.com/docker/docker/api/types/container"
+    "github.com/docker/docker/pkg/stdcopy"
+)
+
+type LogLine struct {
+    Stream string `json:"stream"`
+    Line   string `json:"line"`
+}
+
+type LogsResponse struct {
+    ID    string    `json:"id"`
+    TTY   bool      `json:"tty"`
+    Lines []LogLine `json:"lines"`
+}
+
+// lineWriter splits a demultiplexed stream into lines and hands each
+// complete line to emit.
+type lineWriter struct {
+    stream string
+    buf    []byte
+    emit   func(LogLine) error
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+    lw.buf = append(lw.buf, p...)
+    for {
+        i := bytes.IndexByte(lw.buf, '\n')
+        if i < 0 {
+            break
+        }
+        line := strings.TrimSuffix(string(lw.buf[:i]), "\r")
+        lw.buf = lw.buf[i+1:]
+        if err := lw.emit(LogLine{Stream: lw.stream, Line: line}); err != nil {
+            return 0, err
+        }
+    }
+    return len(p), nil
+}
+
+func (lw *lineWriter) flush() error {
+    if len(lw.buf) == 0 {
+        return nil
+    }
+    line := string(lw.buf)
+    lw.buf = nil
+    return lw.emit(LogLine{Stream: lw.stream, Line: line})
+}
+
+// ContainerLogsHandler returns container output as JSON, or streams it as
+// server-sent events when follow=true. Query parameters: id, tail, since,
+// until, timestamps, stdout, stderr, follow.
+func ContainerLogsHandler(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    id := server.PathOr(r, "id", q.Get("id"))
+    if id == "" {
+        response.BadRequest(w, "Missing container id")
+        return
+    }
+
+    opts := container.LogsOptions{
+        ShowStdout: queryBool(q.Get("stdout"), true),
+        ShowStderr: queryBool(q.Get("stderr"), true),
+        Since:      q.Get("since"),
+        Until:      q.Get("until"),
+        Timestamps: queryBool(q.Get("timestamps"), false),
+        Follow:     queryBool(q.Get("follow"), false),
+        Tail:       q.Get("tail"),
+    }
+    if opts.Tail == "" {
+        opts.Tail = "100"
+    }
+    if !opts.ShowStdout && !opts.ShowStderr {
+        response.BadRequest(w, "At least one of stdout or stderr must be selected")
+        return
+    }
+
+    cli := dockerClient()
+    info, err := cli.ContainerInspect(r.Context(), id)
+    if err != nil {
+        response.FromError(w, err)
+        return
+    }
+
+    ctx := r.Context()
+    if opts.Follow {
+        var cancel context.CancelFunc
+        ctx, cancel = server.StreamContext(ctx)
+        defer cancel()
+    }
+
+    body, err := cli.ContainerLogs(ctx, id, opts)
+    if err != nil {
+        response.FromError(w, err)
+        return
+    }
+    defer body.Close()
+
+    var emit func(LogLine) error
+    var lines []LogLine
+    if opts.Follow {
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.Header().Set("X-Accel-Buffering", "no")
+        // Followed logs outlive the server's write timeout.
+        http.NewResponseController(w).SetWriteDeadline(time.Time{})
+        w.WriteHeader(http.StatusOK)
+        flusher, _ := w.(http.Flusher)
+        emit = func(l LogLine) error {
+            if err := writeSSE(w, l.Stream, l.Line); err != nil {
+                return err
+            }
+            if flusher != nil {
+                flusher.Flush()
+            }
+            return nil
+        }
+    } else {
+        lines = []LogLine{}
+        emit = func(l LogLine) error {
+            lines = append(lines, l)
+            return nil
+        }
+    }
+
+    stdout := &lineWriter{stream: "stdout", emit: emit}
+    stderr := &lineWriter{stream: "stderr", emit: emit}
+    // TTY containers have a single raw stream instead of Docker's
+    // multiplexed stdout/stderr framing.
+    if info.Config != nil && info.Config.Tty {
+        _, err = io.Copy(stdout, body)
+    } else {
+        _, err = stdcopy.StdCopy(stdout, stderr, body)
+    }
+    stdout.flush()
+    stderr.flush()
+
+    if opts.Follow {
+        if err != nil && ctx.Err() == nil {
+            writeSSE(w, "error", err.Error())
+        }
+        return
+    }
+    if err != nil {
+        response.FromError(w, err)
+        return
+    }
+    response.OK(w, LogsResponse{
+        ID:    info.ID,
+        TTY:   info.Config != nil && info.Config.Tty,
+        Lines: lines,
+    })
+}
+
+// writeSSE writes one server-sent event; multi-line data is split into
+// several data fields as the spec requires.
+func writeSSE(w io.Writer, event, data string) error {
+    var b strings.Builder
+    if event != "" {
+        fmt.Fprintf(&b, "event: %s\n", event)
+    }
+    for _, line := range strings.Split(data, "\n") {
+        fmt.Fprintf(&b, "data: %s\n", line)
+    }
+    b.WriteString("\n")
+    _, err := io.WriteString(w, b.String())
+    return err
+}
+
+func queryBool(value string, def bool) bool {
+    if value == "" {
+        return def
+    }
+    b, err := strconv.ParseBool(value)
+    if err != nil {
+        return def
+    }
+    return b
+}
@@ -0,0 +1,143 @@
+package docker
+
+import (
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+
+    "agent/metrics"
+)
+
+// instrumentedTransport counts Docker API calls and their failures by
+// operation for /metrics.
+type instrumentedTransport struct {
+    base *http.Transport
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    op := apiOperation(req.Method, req.URL.Path)
+    resp, err := t.base.RoundTrip(req)
+    switch {
+    case err != nil:
+        metrics.DockerCall(op, "transport")
+    case resp.StatusCode >= 400:
+        metrics.DockerCall(op, strconv.Itoa(resp.StatusCode))
+    default:
+        metrics.DockerCall(op, "")
+    }
+    return resp, err
+}
+
+func (t *instrumentedTransport) CloseIdleConnections() {
+    t.base.CloseIdleConnections()
+}
+
+// Path segments that follow a resource name but are not object ids.
+var apiLiterals = map[string]bool{
+    "json": true, "create": true, "prune": true, "search": true, "load": true, "get": true,
+}
+
+// apiOperation turns an Engine API path such as
+// /v1.47/containers/3f2a.../start into "POST /containers/{id}/start" so
+// the label stays bounded.
+func apiOperation(method, path string) string {
+    parts := strings.Split(strings.Trim(path, "/"), "/")
+    if len(parts) > 0 && strings.HasPrefix(parts[0], "v1.") {
+        parts = parts[1:]
+    }
+    if len(parts) >= 2 && !apiLiterals[parts[1]] {
+        switch parts[0] {
+        case "images":
+            // Image references contain slashes; keep only a trailing action.
+            last := parts[len(parts)-1]
+            normalized := []string{"images", "{name}"}
+            if len(parts) > 2 && (last == "json" || last == "history" || last == "push" || last == "tag") {
+                normalized = append(normalized, last)
+            }
+            parts = normalized
+        case "containers", "networks", "exec", "volumes", "plugins":
+            parts[1] = "{id}"
+        }
+    }
+    return method + " /" + strings.Join(parts, "/")
+}
+
+// WriteContainerMetrics exports the collector's latest snapshots,
+// labelled by container name and the labels set at create time.
+func WriteContainerMetrics(e *metrics.Encoder) {
+    samples := collector.samples()
+
+    gauges := []struct {
+        name  string
+        kind  string
+        help  string
+        value func(ContainerStatsSnapshot) float64
+    }{
+        {"agent_container_cpu_percent", "gauge", "CPU usage in percent of one core.",
+            func(s ContainerStatsSnapshot) float64 { return s.CPUPercent }},
+        {"agent_container_cpu_limit_percent", "gauge", "CPU limit in percent of one core.",
+            func(s ContainerStatsSnapshot) float64 { return s.CPULimitPercent }},
+        {"agent_container_memory_usage_bytes", "gauge", "Memory usage without inactive page cache.",
+            func(s ContainerStatsSnapshot) float64 { return s.MemUsageMB * 1024 * 1024 }},
+        {"agent_container_memory_limit_bytes", "gauge", "Memory limit.",
+            func(s ContainerStatsSnapshot) float64 { return s.MemLimitMB * 1024 * 1024 }},
+        {"agent_container_network_receive_bytes_total", "counter", "Bytes received on all interfaces.",
+            func(s ContainerStatsSnapshot) float64 { return float64(s.NetworkRx) }},
+        {"agent_container_network_transmit_bytes_total", "counter", "Bytes sent on all interfaces.",
+            func(s ContainerStatsSnapshot) float64 { return float64(s.NetworkTx) }},
+        {"agent_container_network_receive_bytes_per_second", "gauge", "Receive rate since the previous sample.",
+            func(s ContainerStatsSnapshot) float64 { return s.NetworkRxRate }},
+        {"agent_container_network_transmit_bytes_per_second", "gauge", "Transmit rate since the previous sample.",
+            func(s ContainerStatsSnapshot) float64 { return s.NetworkTxRate }},
+        {"agent_container_block_read_bytes_total", "counter", "Bytes read from block devices.",
+            func(s ContainerStatsSnapshot) float64 { return float64(s.BlockRead) }},
+        {"agent_container_block_write_bytes_total", "counter", "Bytes written to block devices.",
+            func(s ContainerStatsSnapshot) float64 { return float64(s.BlockWrite) }},
+        {"agent_container_pids", "gauge", "Number of processes.",
+            func(s ContainerStatsSnapshot) float64 { return float64(s.PidsCurrent) }},
+    }
+
+    labels := make([][]metrics.Label, len(samples))
+    for i, s := range samples {
+        l := []metrics.Label{{Name: "name", Value: s.Name}, {Name: "id", Value: shortID(s.ID)}}
+        // Keys such as a.b and a_b sanitise to the same name, and a
+        // sample with a repeated label fails the whole scrape. The first
+        // key in sort order keeps the name.
+        seen := make(map[string]bool)
+        for _, k := range sortedKeys(s.labels) {
+            name := metrics.LabelName("label_", k)
+            if seen[name] {
+                continue
+            }
+            seen[name] = true
+            l = append(l, metrics.Label{Name: name, Value: s.labels[k]})
+        }
+        labels[i] = l
+    }
+
+    e.Family("agent_containers_running", "gauge", "Running containers tracked by the stats collector.")
+    e.Sample("agent_containers_running", nil, float64(len(samples)))
+    for _, g := range gauges {
+        e.Family(g.name, g.kind, g.help)
+        for i, s := range samples {
+            e.Sample(g.name, labels[i], g.value(s.ContainerStatsSnapshot))
+        }
+    }
+}
+
+func sortedKeys(m map[string]string) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func shortID(id string) string {
+    if len(id) > 12 {
+        return id[:12]
+    }
+    return id
+}
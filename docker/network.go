@@ -1,11 +1,13 @@
 package docker
 
 import (
-    "context"
     "encoding/json"
     "net/http"
+
+    "agent/response"
+    "agent/server"
+
     "github.com/docker/docker/api/types/network"
-    "github.com/docker/docker/client"
 )
 
 type CreateNetworkRequest struct {
@@ -20,21 +22,64 @@ type CreateNetworkRequest struct {
     Options    map[string]string `json:"options"`
 }
 
+type CreateNetworkResponse struct {
+    ID string `json:"id"`
+}
+
+type NetworkListResponse struct {
+    Networks []network.Summary `json:"networks"`
+}
+
+// NetworkAttachment describes one network endpoint of a container.
+type NetworkAttachment struct {
+    Name       string   `json:"name"`
+    IPv4       string   `json:"ipv4"`
+    IPv6       string   `json:"ipv6"`
+    Aliases    []string `json:"aliases"`
+    MacAddress string   `json:"mac_address"`
+}
+
+// ConnectNetworkRequest names the endpoint settings one by one; the
+// network comes from the network field, not NetworkAttachment.Name.
+type ConnectNetworkRequest struct {
+    Network    string   `json:"network"`
+    Container  string   `json:"container"`
+    IPv4       string   `json:"ipv4"`
+    IPv6       string   `json:"ipv6"`
+    Aliases    []string `json:"aliases"`
+    MacAddress string   `json:"mac_address"`
+}
+
+type DisconnectNetworkRequest struct {
+    Network   string `json:"network"`
+    Container string `json:"container"`
+    Force     bool   `json:"force"`
+}
+
+func endpointSettings(a NetworkAttachment) *network.EndpointSettings {
+    settings := &network.EndpointSettings{
+        Aliases:    a.Aliases,
+        MacAddress: a.MacAddress,
+    }
+    if a.IPv4 != "" || a.IPv6 != "" {
+        settings.IPAMConfig = &network.EndpointIPAMConfig{
+            IPv4Address: a.IPv4,
+            IPv6Address: a.IPv6,
+        }
+    }
+    return settings
+}
+
 func CreateNetworkHandler(w http.ResponseWriter, r *http.Request) {
     var req CreateNetworkRequest
     decoder := json.NewDecoder(r.Body)
     if err := decoder.Decode(&req); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+        response.BadRequest(w, err.Error())
         return
     }
 
-    ctx := context.Background()
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
-    }
-    defer cli.Close()
+    ctx := r.Context()
+    cli := dockerClient()
 
     ipamConfig := []network.IPAMConfig{}
     if req.Subnet != "" || req.Gateway != "" {
@@ -63,30 +108,23 @@ func CreateNetworkHandler(w http.ResponseWriter, r *http.Request) {
 
     resp, err := cli.NetworkCreate(ctx, req.Name, options)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        response.FromError(w, err)
         return
     }
 
-    w.WriteHeader(http.StatusCreated)
-    json.NewEncoder(w).Encode(map[string]string{"id": resp.ID})
+    response.JSON(w, http.StatusCreated, CreateNetworkResponse{ID: resp.ID})
 }
 
 func ListNetworksHandler(w http.ResponseWriter, r *http.Request) {
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
-    }
-    defer cli.Close()
+    cli := dockerClient()
 
-    networks, err := cli.NetworkList(context.Background(), network.ListOptions{})
+    networks, err := cli.NetworkList(r.Context(), network.ListOptions{})
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        response.FromError(w, err)
         return
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{"networks": networks})
+    response.OK(w, NetworkListResponse{Networks: networks})
 }
 
 type DeleteNetworkRequest struct {
@@ -95,24 +133,62 @@ type DeleteNetworkRequest struct {
 
 func DeleteNetworkHandler(w http.ResponseWriter, r *http.Request) {
     var req DeleteNetworkRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
-        http.Error(w, "Missing or invalid network id", http.StatusBadRequest)
+    err := server.DecodeJSON(r, &req)
+    req.ID = server.PathOr(r, "id", req.ID)
+    if err != nil || req.ID == "" {
+        response.BadRequest(w, "Missing or invalid network id")
         return
     }
 
-    cli, err := client.NewClientWithOpts(client.WithHost(dockerHost), client.WithAPIVersionNegotiation())
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+    cli := dockerClient()
+
+    if err := cli.NetworkRemove(r.Context(), req.ID); err != nil {
+        response.FromError(w, err)
         return
     }
-    defer cli.Close()
 
-    err = cli.NetworkRemove(context.Background(), req.ID)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+    response.OK(w, response.Message{Message: "Network deleted"})
+}
+
+func ConnectNetworkHandler(w http.ResponseWriter, r *http.Request) {
+    var req ConnectNetworkRequest
+    err := json.NewDecoder(r.Body).Decode(&req)
+    req.Network = server.PathOr(r, "id", req.Network)
+    if err != nil || req.Network == "" || req.Container == "" {
+        response.BadRequest(w, "Missing or invalid network/container")
+        return
+    }
+
+    cli := dockerClient()
+
+    if err := cli.NetworkConnect(r.Context(), req.Network, req.Container, endpointSettings(NetworkAttachment{
+        IPv4:       req.IPv4,
+        IPv6:       req.IPv6,
+        Aliases:    req.Aliases,
+        MacAddress: req.MacAddress,
+    })); err != nil {
+        response.FromError(w, err)
+        return
+    }
+
+    response.OK(w, response.Message{Message: "Container connected"})
+}
+
+func DisconnectNetworkHandler(w http.ResponseWriter, r *http.Request) {
+    var req DisconnectNetworkRequest
+    err := json.NewDecoder(r.Body).Decode(&req)
+    req.Network = server.PathOr(r, "id", req.Network)
+    if err != nil || req.Network == "" || req.Container == "" {
+        response.BadRequest(w, "Missing or invalid network/container")
+        return
+    }
+
+    cli := dockerClient()
+
+    if err := cli.NetworkDisconnect(r.Context(), req.Network, req.Container, req.Force); err != nil {
+        response.FromError(w, err)
         return
     }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "Network deleted"})
+    response.OK(w, response.Message{Message: "Container disconnected"})
 }
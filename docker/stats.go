@@ -0,0 +1,351 @@
+package docker
+
+import (
+    "context"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "runtime"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "agent/response"
+    "agent/server"
+
+    "github.com/docker/docker/api/types/container"
+)
+
+type StatsResponse struct {
+    Containers []ContainerStatsSnapshot `json:"containers"`
+}
+
+// ContainerStatsSnapshot is the computed view of one stats sample, shared
+// by /container/stats_by_name and the background collector. Rates are
+// per second against the previous cached sample and zero without one.
+type ContainerStatsSnapshot struct {
+    ID              string                    `json:"id"`
+    Name            string                    `json:"name"`
+    CPUPercent      float64                   `json:"cpu_percent"`
+    CPULimitPercent float64                   `json:"cpu_limit_percent"`
+    MemUsageMB      float64                   `json:"mem_usage_mb"`
+    MemCacheMB      float64                   `json:"mem_cache_mb"`
+    MemLimitMB      float64                   `json:"mem_limit_mb"`
+    NetworkRx       uint64                    `json:"network_rx_bytes"`
+    NetworkTx       uint64                    `json:"network_tx_bytes"`
+    NetworkRxRate   float64                   `json:"network_rx_bytes_per_sec"`
+    NetworkTxRate   float64                   `json:"network_tx_bytes_per_sec"`
+    BlockRead       uint64                    `json:"block_read_bytes"`
+    BlockWrite      uint64                    `json:"block_write_bytes"`
+    // Operation counts come from the cgroup v1 blkio controller and are
+    // omitted on cgroup v2 hosts, where Docker does not report them.
+    BlockReadOps    *uint64                   `json:"block_read_ops,omitempty"`
+    BlockWriteOps   *uint64                   `json:"block_write_ops,omitempty"`
+    BlockReadRate   float64                   `json:"block_read_bytes_per_sec"`
+    BlockWriteRate  float64                   `json:"block_write_bytes_per_sec"`
+    PidsCurrent     uint64                    `json:"pids_current"`
+    PidsLimit       uint64                    `json:"pids_limit"`
+    HostCPUs        int                       `json:"host_cpus"`
+    Interfaces      map[string]InterfaceStats `json:"interfaces"`
+    Timestamp       time.Time                 `json:"timestamp"`
+}
+
+type InterfaceStats struct {
+    RxBytes   uint64  `json:"rx_bytes"`
+    RxPackets uint64  `json:"rx_packets"`
+    RxErrors  uint64  `json:"rx_errors"`
+    RxDropped uint64  `json:"rx_dropped"`
+    TxBytes   uint64  `json:"tx_bytes"`
+    TxPackets uint64  `json:"tx_packets"`
+    TxErrors  uint64  `json:"tx_errors"`
+    TxDropped uint64  `json:"tx_dropped"`
+    RxRate    float64 `json:"rx_bytes_per_sec"`
+    TxRate    float64 `json:"tx_bytes_per_sec"`
+}
+
+func buildStatsSnapshot(containerID, name string, hostConfig *container.HostConfig, stats container.Stats) ContainerStatsSnapshot {
+    hostCPUs := len(stats.CPUStats.CPUUsage.PercpuUsage)
+    if hostCPUs == 0 {
+        hostCPUs = runtime.NumCPU()
+    }
+
+    current, previous := updateStatsCache(containerID, stats)
+    cpuPercent := calculateCPUPercentage(stats, current, previous)
+    memUsed, memCache := calculateMemoryUsage(stats.MemoryStats)
+    memUsage := float64(memUsed) / (1024 * 1024)
+    memLimit := float64(stats.MemoryStats.Limit) / (1024 * 1024)
+    networkRx, networkTx, networkRxRate, networkTxRate := calculateNetworkUsage(current, previous)
+    cpuLimitPercent := float64(hostCPUs * 100)
+    if hostConfig != nil {
+        if hostConfig.NanoCPUs > 0 {
+            cpuLimitPercent = float64(hostConfig.NanoCPUs) / 10000000
+        } else if hostConfig.CPUQuota > 0 && hostConfig.CPUPeriod > 0 {
+            cpuLimitPercent = float64(hostConfig.CPUQuota) / float64(hostConfig.CPUPeriod) * 100
+        }
+    }
+
+    snapshot := ContainerStatsSnapshot{
+        ID:              containerID,
+        Name:            name,
+        CPUPercent:      cpuPercent,
+        CPULimitPercent: cpuLimitPercent,
+        MemUsageMB:      memUsage,
+        MemCacheMB:      float64(memCache) / (1024 * 1024),
+        MemLimitMB:      memLimit,
+        NetworkRx:       networkRx,
+        NetworkTx:       networkTx,
+        NetworkRxRate:   networkRxRate,
+        NetworkTxRate:   networkTxRate,
+        BlockRead:       current.BlockRead,
+        BlockWrite:      current.BlockWrite,
+        PidsCurrent:     stats.PidsStats.Current,
+        PidsLimit:       stats.PidsStats.Limit,
+        HostCPUs:        hostCPUs,
+        Interfaces:      make(map[string]InterfaceStats, len(stats.Networks)),
+        Timestamp:       current.Timestamp,
+    }
+    if len(stats.BlkioStats.IoServicedRecursive) > 0 {
+        readOps, writeOps := sumBlkio(stats.BlkioStats.IoServicedRecursive)
+        snapshot.BlockReadOps, snapshot.BlockWriteOps = &readOps, &writeOps
+    }
+
+    seconds := 0.0
+    if previous != nil {
+        seconds = current.Timestamp.Sub(previous.Timestamp).Seconds()
+        snapshot.BlockReadRate = ratePerSecond(current.BlockRead, previous.BlockRead, seconds)
+        snapshot.BlockWriteRate = ratePerSecond(current.BlockWrite, previous.BlockWrite, seconds)
+    }
+    for iface, n := range stats.Networks {
+        is := InterfaceStats{
+            RxBytes:   n.RxBytes,
+            RxPackets: n.RxPackets,
+            RxErrors:  n.RxErrors,
+            RxDropped: n.RxDropped,
+            TxBytes:   n.TxBytes,
+            TxPackets: n.TxPackets,
+            TxErrors:  n.TxErrors,
+            TxDropped: n.TxDropped,
+        }
+        if previous != nil {
+            if prev, ok := previous.Interfaces[iface]; ok {
+                is.RxRate = ratePerSecond(n.RxBytes, prev.RxBytes, seconds)
+                is.TxRate = ratePerSecond(n.TxBytes, prev.TxBytes, seconds)
+            }
+        }
+        snapshot.Interfaces[iface] = is
+    }
+
+    return snapshot
+}
+
+var collector = &statsCollector{
+    interval: 5 * time.Second,
+    streams:  make(map[string]*statsStream),
+    latest:   make(map[string]ContainerStatsSnapshot),
+    labels:   make(map[string]map[string]string),
+}
+
+// statsCollector keeps one streaming stats call open per running
+// container and remembers the latest computed snapshot for each.
+type statsCollector struct {
+    interval time.Duration
+
+    mu      sync.RWMutex
+    streams map[string]*statsStream
+    latest  map[string]ContainerStatsSnapshot
+    // labels holds the create-time labels of each running container.
+    labels map[string]map[string]string
+}
+
+type statsStream struct {
+    cancel context.CancelFunc
+}
+
+// StartStatsCollector begins collecting stats for every running container
+// until ctx is cancelled. The container set is refreshed every interval.
+func StartStatsCollector(ctx context.Context, interval time.Duration) {
+    if interval > 0 {
+        collector.interval = interval
+    }
+    go collector.run(ctx)
+}
+
+func (c *statsCollector) run(ctx context.Context) {
+    ticker := time.NewTicker(c.interval)
+    defer ticker.Stop()
+    for {
+        c.refresh(ctx)
+        select {
+        case <-ctx.Done():
+            c.mu.Lock()
+            for id, st := range c.streams {
+                st.cancel()
+                delete(c.streams, id)
+            }
+            c.mu.Unlock()
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+func (c *statsCollector) refresh(ctx context.Context) {
+    containers, err := dockerClient().ContainerList(ctx, container.ListOptions{})
+    if err != nil {
+        slog.Warn("docker: stats collector could not list containers", "error", err)
+        return
+    }
+
+    running := make(map[string]string, len(containers))
+    for _, ct := range containers {
+        name := ""
+        if len(ct.Names) > 0 {
+            name = strings.TrimPrefix(ct.Names[0], "/")
+        }
+        running[ct.ID] = name
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.labels = make(map[string]map[string]string, len(containers))
+    for _, ct := range containers {
+        c.labels[ct.ID] = ct.Labels
+    }
+    for id, name := range running {
+        if _, ok := c.streams[id]; ok {
+            continue
+        }
+        streamCtx, cancel := context.WithCancel(ctx)
+        st := &statsStream{cancel: cancel}
+        c.streams[id] = st
+        go c.stream(streamCtx, st, id, name)
+    }
+    for id, st := range c.streams {
+        if _, ok := running[id]; !ok {
+            st.cancel()
+            delete(c.streams, id)
+        }
+    }
+    for id := range c.latest {
+        if _, ok := running[id]; !ok {
+            delete(c.latest, id)
+        }
+    }
+    evictStatsCache(running)
+}
+
+func (c *statsCollector) stream(ctx context.Context, st *statsStream, id, name string) {
+    defer func() {
+        // Let the next refresh restart the stream if the container is
+        // still running.
+        st.cancel()
+        c.mu.Lock()
+        if c.streams[id] == st {
+            delete(c.streams, id)
+        }
+        c.mu.Unlock()
+    }()
+
+    cli := dockerClient()
+    info, err := cli.ContainerInspect(ctx, id)
+    if err != nil {
+        return
+    }
+    resp, err := cli.ContainerStats(ctx, id, true)
+    if err != nil {
+        return
+    }
+    defer resp.Body.Close()
+
+    dec := json.NewDecoder(resp.Body)
+    for {
+        var stats container.Stats
+        if err := dec.Decode(&stats); err != nil {
+            return
+        }
+        snapshot := buildStatsSnapshot(id, name, info.HostConfig, stats)
+        c.mu.Lock()
+        c.latest[id] = snapshot
+        c.mu.Unlock()
+    }
+}
+
+func (c *statsCollector) snapshots() []ContainerStatsSnapshot {
+    c.mu.RLock()
+    out := make([]ContainerStatsSnapshot, 0, len(c.latest))
+    for _, s := range c.latest {
+        out = append(out, s)
+    }
+    c.mu.RUnlock()
+    sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+    return out
+}
+
+type labelledSnapshot struct {
+    ContainerStatsSnapshot
+    labels map[string]string
+}
+
+// samples is snapshots with each container's labels attached.
+func (c *statsCollector) samples() []labelledSnapshot {
+    c.mu.RLock()
+    out := make([]labelledSnapshot, 0, len(c.latest))
+    for id, s := range c.latest {
+        out = append(out, labelledSnapshot{ContainerStatsSnapshot: s, labels: c.labels[id]})
+    }
+    c.mu.RUnlock()
+    sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+    return out
+}
+
+// evictStatsCache drops cached samples for containers that are no longer
+// running.
+func evictStatsCache(running map[string]string) {
+    statsMutex.Lock()
+    defer statsMutex.Unlock()
+    for id := range statsCache {
+        if _, ok := running[id]; !ok {
+            delete(statsCache, id)
+        }
+    }
+}
+
+// ContainerStatsHandler returns the latest stats of every running
+// container, or streams them as server-sent events when stream=true.
+func ContainerStatsHandler(w http.ResponseWriter, r *http.Request) {
+    if !queryBool(r.URL.Query().Get("stream"), false) {
+        response.OK(w, StatsResponse{Containers: collector.snapshots()})
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("X-Accel-Buffering", "no")
+    http.NewResponseController(w).SetWriteDeadline(time.Time{})
+    w.WriteHeader(http.StatusOK)
+    flusher, _ := w.(http.Flusher)
+
+    ctx, cancel := server.StreamContext(r.Context())
+    defer cancel()
+
+    ticker := time.NewTicker(collector.interval)
+    defer ticker.Stop()
+    for {
+        data, err := json.Marshal(collector.snapshots())
+        if err != nil {
+            return
+        }
+        if err := writeSSE(w, "stats", string(data)); err != nil {
+            return
+        }
+        if flusher != nil {
+            flusher.Flush()
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
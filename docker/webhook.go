@@ -0,0 +1,163 @@
+package docker
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+)
+
+// WebhookConfig sends matching events to URL as JSON POSTs. With a
+// secret each request carries
+//
+//	X-Agent-Timestamp: <unix seconds>
+//	X-Agent-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// so the receiver can check origin and reject replays.
+type WebhookConfig struct {
+    URL        string   `json:"url"`
+    Secret     string   `json:"secret"`
+    Types      []string `json:"types"`
+    Labels     []string `json:"labels"`
+    MaxRetries int      `json:"max_retries"`
+    Timeout    string   `json:"timeout"`
+}
+
+const (
+    defaultWebhookRetries = 5
+    defaultWebhookTimeout = 10 * time.Second
+    // Backlog held for a slow receiver before it has to catch up from
+    // the relay buffer.
+    webhookQueue = 1024
+)
+
+type webhook struct {
+    url        string
+    secret     []byte
+    filter     eventFilter
+    maxRetries int
+    client     *http.Client
+}
+
+func newWebhook(cfg WebhookConfig) (*webhook, error) {
+    u, err := url.Parse(cfg.URL)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return nil, fmt.Errorf("events: invalid webhook url %q", cfg.URL)
+    }
+    filter, err := parseEventFilter(cfg.Types, cfg.Labels)
+    if err != nil {
+        return nil, fmt.Errorf("events: invalid webhook filter: %v", err)
+    }
+    timeout := defaultWebhookTimeout
+    if cfg.Timeout != "" {
+        if timeout, err = time.ParseDuration(cfg.Timeout); err != nil || timeout <= 0 {
+            return nil, fmt.Errorf("events: invalid webhook timeout %q", cfg.Timeout)
+        }
+    }
+    wh := &webhook{
+        url:        cfg.URL,
+        secret:     []byte(cfg.Secret),
+        filter:     filter,
+        maxRetries: cfg.MaxRetries,
+        client:     &http.Client{Timeout: timeout},
+    }
+    if wh.maxRetries <= 0 {
+        wh.maxRetries = defaultWebhookRetries
+    }
+    return wh, nil
+}
+
+// run delivers events in order. When delivery falls behind far enough to
+// be dropped by the relay it resubscribes from the last delivered event.
+func (wh *webhook) run(ctx context.Context) {
+    var last int64
+    for ctx.Err() == nil {
+        replay, sub := relay.subscribe(last, webhookQueue)
+        for _, e := range replay {
+            wh.deliver(ctx, e)
+            last = e.TimeNano
+        }
+        for open := true; open; {
+            select {
+            case e, ok := <-sub.ch:
+                // The closed channel yields the queued events first, so
+                // last is the newest one received when the relay dropped
+                // the subscription.
+                if !ok {
+                    open = false
+                    slog.Warn("events: webhook fell behind, catching up from buffer")
+                    break
+                }
+                wh.deliver(ctx, e)
+                last = e.TimeNano
+            case <-ctx.Done():
+                open = false
+            }
+        }
+        relay.unsubscribe(sub)
+    }
+}
+
+// deliver posts e, retrying with exponential backoff on network errors,
+// 429 and 5xx. Other responses are final.
+func (wh *webhook) deliver(ctx context.Context, e Event) {
+    if !wh.filter.match(e) {
+        return
+    }
+    body, err := json.Marshal(e)
+    if err != nil {
+        return
+    }
+    backoff := time.Second
+    for attempt := 0; ; attempt++ {
+        status, err := wh.post(ctx, e, body)
+        if err == nil && status < 300 {
+            return
+        }
+        retry := err != nil || status == http.StatusTooManyRequests || status >= 500
+        if !retry || attempt >= wh.maxRetries || ctx.Err() != nil {
+            slog.Error("events: webhook delivery failed", "event", e.Type+"."+e.Action, "id", e.ID, "status", status, "error", err, "attempts", attempt+1)
+            return
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(backoff):
+        }
+        backoff = min(2*backoff, 30*time.Second)
+    }
+}
+
+func (wh *webhook) post(ctx context.Context, e Event, body []byte) (int, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+    if err != nil {
+        return 0, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Agent-Event", e.Type+"."+e.Action)
+    if len(wh.secret) > 0 {
+        ts := strconv.FormatInt(time.Now().Unix(), 10)
+        mac := hmac.New(sha256.New, wh.secret)
+        mac.Write([]byte(ts + "."))
+        mac.Write(body)
+        req.Header.Set("X-Agent-Timestamp", ts)
+        req.Header.Set("X-Agent-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+    }
+    resp, err := wh.client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    // Drain so the connection can be reused.
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+    resp.Body.Close()
+    return resp.StatusCode, nil
+}
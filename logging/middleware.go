@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"agent/authorization"
+	"agent/server"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// IDs from callers are kept when they are short and safe to log as is.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Probes and scrapes are only logged at debug level.
+var quietPaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// Middleware assigns each request an ID, or keeps the caller's
+// X-Request-ID, returns it in the response and logs one line per request
+// once it is done.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		r = r.WithContext(WithRequestID(r.Context(), id))
+
+		lw := &logWriter{StatusWriter: server.StatusWriter{ResponseWriter: w}}
+		next.ServeHTTP(lw, r)
+
+		status := lw.Code()
+		lvl := slog.LevelInfo
+		switch {
+		case status >= 500:
+			lvl = slog.LevelError
+		case quietPaths[r.URL.Path]:
+			lvl = slog.LevelDebug
+		}
+		clientIP := authorization.ClientIP(r)
+		if _, ok := server.PeerCredFromContext(r.Context()); ok {
+			clientIP = "unix"
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", r.Pattern),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", clientIP),
+		}
+		if lw.err != nil {
+			attrs = append(attrs, slog.String("error", lw.err.Error()))
+		}
+		slog.LogAttrs(r.Context(), lvl, "request", attrs...)
+	})
+}
+
+// logWriter also keeps the error a handler answered with; see
+// response.WriteError.
+type logWriter struct {
+	server.StatusWriter
+	err error
+}
+
+func (w *logWriter) RecordError(err error) {
+	w.err = err
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"agent/server"
+)
+
+// Latency buckets in seconds, the Prometheus client defaults.
+var buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type routeKey struct {
+	route  string
+	method string
+}
+
+type statusKey struct {
+	routeKey
+	status int
+}
+
+type dockerKey struct {
+	operation string
+	code      string
+}
+
+var (
+	mu           sync.Mutex
+	requests     = make(map[statusKey]uint64)
+	latencies    = make(map[routeKey]*histogram)
+	dockerCalls  = make(map[string]uint64)
+	dockerErrors = make(map[dockerKey]uint64)
+)
+
+// Instrument counts requests and observes their latency by route
+// pattern, method and status.
+func Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &server.StatusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		// The method has its own label; keep only the path of the pattern.
+		route := r.Pattern
+		if _, path, ok := strings.Cut(route, " "); ok {
+			route = path
+		}
+		observeRequest(route, r.Method, sw.Code(), time.Since(start))
+	})
+}
+
+func observeRequest(route, method string, status int, d time.Duration) {
+	key := routeKey{route: route, method: method}
+	seconds := d.Seconds()
+
+	mu.Lock()
+	defer mu.Unlock()
+	requests[statusKey{routeKey: key, status: status}]++
+	h := latencies[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(buckets))}
+		latencies[key] = h
+	}
+	for i, le := range buckets {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// DockerCall records one Docker API call. code is empty on success and
+// otherwise the HTTP status or "transport" when no response arrived.
+func DockerCall(operation, code string) {
+	mu.Lock()
+	defer mu.Unlock()
+	dockerCalls[operation]++
+	if code != "" {
+		dockerErrors[dockerKey{operation: operation, code: code}]++
+	}
+}
+
+func writeHTTPMetrics(e *Encoder) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	e.Family("agent_http_requests_total", "counter", "HTTP requests by route, method and status.")
+	for _, k := range sortedStatusKeys() {
+		e.Sample("agent_http_requests_total", []Label{
+			{"route", k.route}, {"method", k.method}, {"status", strconv.Itoa(k.status)},
+		}, float64(requests[k]))
+	}
+
+	e.Family("agent_http_request_duration_seconds", "histogram", "HTTP request latency by route and method.")
+	for _, k := range sortedRouteKeys() {
+		h := latencies[k]
+		base := []Label{{"route", k.route}, {"method", k.method}}
+		for i, le := range buckets {
+			e.Sample("agent_http_request_duration_seconds_bucket",
+				append(base[:2:2], Label{"le", formatValue(le)}), float64(h.counts[i]))
+		}
+		e.Sample("agent_http_request_duration_seconds_bucket", append(base[:2:2], Label{"le", "+Inf"}), float64(h.count))
+		e.Sample("agent_http_request_duration_seconds_sum", base, h.sum)
+		e.Sample("agent_http_request_duration_seconds_count", base, float64(h.count))
+	}
+
+	e.Family("agent_docker_api_requests_total", "counter", "Docker Engine API calls by operation.")
+	for _, op := range sortedKeys(dockerCalls) {
+		e.Sample("agent_docker_api_requests_total", []Label{{"operation", op}}, float64(dockerCalls[op]))
+	}
+
+	e.Family("agent_docker_api_errors_total", "counter", "Failed Docker Engine API calls by operation and status code.")
+	keys := make([]dockerKey, 0, len(dockerErrors))
+	for k := range dockerErrors {
+		keys = append(keys, k)
+	}
+	sortSlice(keys, func(a, b dockerKey) bool {
+		return a.operation < b.operation || a.operation == b.operation && a.code < b.code
+	})
+	for _, k := range keys {
+		e.Sample("agent_docker_api_errors_total", []Label{{"operation", k.operation}, {"code", k.code}}, float64(dockerErrors[k]))
+	}
+}
+
+func sortedStatusKeys() []statusKey {
+	keys := make([]statusKey, 0, len(requests))
+	for k := range requests {
+		keys = append(keys, k)
+	}
+	sortSlice(keys, func(a, b statusKey) bool {
+		if a.routeKey != b.routeKey {
+			return lessRoute(a.routeKey, b.routeKey)
+		}
+		return a.status < b.status
+	})
+	return keys
+}
+
+func sortedRouteKeys() []routeKey {
+	keys := make([]routeKey, 0, len(latencies))
+	for k := range latencies {
+		keys = append(keys, k)
+	}
+	sortSlice(keys, lessRoute)
+	return keys
+}
+
+func lessRoute(a, b routeKey) bool {
+	return a.route < b.route || a.route == b.route && a.method < b.method
+}
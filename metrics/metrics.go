@@ -0,0 +1,200 @@
+// Package metrics serves agent and container metrics in the Prometheus
+// text exposition format. It has no dependencies beyond the standard
+// library; other packages contribute samples through Register.
+package metrics
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"agent/authorization"
+	"agent/response"
+	"agent/server"
+)
+
+// Config protects /metrics independently of the API credentials. With
+// neither a token nor allowed_ips set the endpoint is open.
+type Config struct {
+	Enabled    bool     `json:"enabled"`
+	Token      string   `json:"token"`
+	AllowedIPs []string `json:"allowed_ips"`
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Encoder writes metric families. Call Family once before the samples
+// of each metric.
+type Encoder struct {
+	w *bufio.Writer
+}
+
+func (e *Encoder) Family(name, kind, help string) {
+	e.w.WriteString("# HELP " + name + " " + help + "\n")
+	e.w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+func (e *Encoder) Sample(name string, labels []Label, value float64) {
+	e.w.WriteString(name)
+	if len(labels) > 0 {
+		e.w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				e.w.WriteByte(',')
+			}
+			e.w.WriteString(l.Name + `="` + escapeLabel(l.Value) + `"`)
+		}
+		e.w.WriteByte('}')
+	}
+	e.w.WriteByte(' ')
+	e.w.WriteString(formatValue(value))
+	e.w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// LabelName turns an arbitrary key, e.g. a Docker label, into a valid
+// Prometheus label name.
+func LabelName(prefix, key string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	for _, r := range key {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+var (
+	collectorsMu sync.Mutex
+	collectors   []func(*Encoder)
+)
+
+// Register adds a function that writes its own families on every scrape.
+func Register(collect func(*Encoder)) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	collectors = append(collectors, collect)
+}
+
+var (
+	cfgMu   sync.Mutex
+	enabled bool
+	token   string
+	nets    []*net.IPNet
+)
+
+// Init applies the access rules for /metrics. The endpoint answers 404
+// until it is called with Enabled set.
+func Init(cfg Config) {
+	var allowed []*net.IPNet
+	for _, entry := range cfg.AllowedIPs {
+		e := strings.TrimSpace(entry)
+		if _, cidr, err := net.ParseCIDR(e); err == nil {
+			allowed = append(allowed, cidr)
+			continue
+		}
+		if ip := net.ParseIP(e); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			allowed = append(allowed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		slog.Warn("metrics: ignoring invalid allowed_ips entry", "entry", e)
+	}
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+	enabled, token, nets = cfg.Enabled, cfg.Token, allowed
+}
+
+// ScrapeHandler serves /metrics. It has its own token and allowlist
+// instead of the API credentials so a scraper needs no API access.
+func ScrapeHandler(w http.ResponseWriter, r *http.Request) {
+	cfgMu.Lock()
+	on, tok, allowed := enabled, token, nets
+	cfgMu.Unlock()
+	if !on {
+		response.Fail(w, http.StatusNotFound, response.CodeNotFound, "Metrics are not enabled")
+		return
+	}
+	if tok != "" {
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(tok)) != 1 {
+			response.Fail(w, http.StatusUnauthorized, response.CodeUnauthorized, "Unauthorized")
+			return
+		}
+	}
+	// Unix socket peers are local and have no address to check.
+	if _, viaSocket := server.PeerCredFromContext(r.Context()); len(allowed) > 0 && !viaSocket {
+		ip := net.ParseIP(authorization.ClientIP(r))
+		ok := false
+		for _, n := range allowed {
+			if ip != nil && n.Contains(ip) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			response.Fail(w, http.StatusForbidden, response.CodeForbidden, "Forbidden: client IP not allowed")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e := &Encoder{w: bufio.NewWriter(w)}
+	writeHTTPMetrics(e)
+	collectorsMu.Lock()
+	fns := make([]func(*Encoder), len(collectors))
+	copy(fns, collectors)
+	collectorsMu.Unlock()
+	for _, collect := range fns {
+		collect(e)
+	}
+	e.w.Flush()
+}
+
+// sortedKeys returns the keys of m in a stable order so scrapes diff
+// cleanly.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortSlice[T any](s []T, less func(a, b T) bool) {
+	sort.Slice(s, func(i, j int) bool { return less(s[i], s[j]) })
+}
@@ -0,0 +1,167 @@
+package nginx
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"agent/response"
+	"agent/server"
+)
+
+type VhostRequest struct {
+	Username    string   `json:"username"`
+	ServerName  string   `json:"server_name"`
+	Aliases     []string `json:"aliases"`
+	PHPUpstream string   `json:"php_upstream"`
+}
+
+type VhostResponse struct {
+	Message string `json:"message,omitempty"`
+	Content string `json:"content"`
+}
+
+type DeleteVhostRequest struct {
+	Username   string `json:"username"`
+	ServerName string `json:"server_name"`
+}
+
+var (
+	validName     = regexp.MustCompile(`^[a-zA-Z0-9.\-_]+$`)
+	validUpstream = regexp.MustCompile(`^(unix:/[a-zA-Z0-9./\-_]+|[a-zA-Z0-9.\-_]+:[0-9]+|\[[0-9a-fA-F:]+\]:[0-9]+)$`)
+)
+
+func isValidName(name string) bool {
+	return validName.MatchString(name) && name != "." && name != ".."
+}
+
+// validateVhostRequest writes the error response itself and reports
+// whether the handler may continue.
+func validateVhostRequest(w http.ResponseWriter, req VhostRequest) bool {
+	if req.Username == "" || req.ServerName == "" {
+		response.BadRequest(w, "Username and server_name required")
+		return false
+	}
+	if !isValidName(req.Username) {
+		response.BadRequest(w, "Invalid username: only letters, numbers, ., -, _ allowed")
+		return false
+	}
+	if !isValidName(req.ServerName) {
+		response.BadRequest(w, "Invalid server_name: only letters, numbers, ., -, _ allowed")
+		return false
+	}
+	for _, alias := range req.Aliases {
+		if !isValidName(alias) {
+			response.BadRequest(w, "Invalid alias: only letters, numbers, ., -, _ allowed")
+			return false
+		}
+	}
+	if req.PHPUpstream != "" && !validUpstream.MatchString(req.PHPUpstream) {
+		response.BadRequest(w, "Invalid php_upstream: expected host:port or unix:/path")
+		return false
+	}
+	if _, err := os.Stat(filepath.Join("/home", req.Username, req.ServerName)); os.IsNotExist(err) {
+		response.Fail(w, http.StatusNotFound, "domain_not_found", "Domain directory does not exist")
+		return false
+	}
+	return true
+}
+
+func renderRequest(req VhostRequest) (string, error) {
+	return Render(Vhost{
+		Username:    req.Username,
+		ServerName:  req.ServerName,
+		Aliases:     req.Aliases,
+		PHPUpstream: req.PHPUpstream,
+	})
+}
+
+func CreateVhostHandler(w http.ResponseWriter, r *http.Request) {
+	var req VhostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.BadRequest(w, "Invalid request")
+		return
+	}
+	if !validateVhostRequest(w, req) {
+		return
+	}
+	if VhostExists(req.ServerName, req.Username) {
+		response.WriteError(w, ErrVhostExists)
+		return
+	}
+	content, err := renderRequest(req)
+	if err != nil {
+		response.FromError(w, err)
+		return
+	}
+	if err := WriteVhost(req.ServerName, req.Username, content); err != nil {
+		response.FromError(w, err)
+		return
+	}
+	response.JSON(w, http.StatusCreated, VhostResponse{Message: "Vhost created", Content: content})
+}
+
+func UpdateVhostHandler(w http.ResponseWriter, r *http.Request) {
+	var req VhostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		response.BadRequest(w, "Invalid request")
+		return
+	}
+	req.Username = server.PathOr(r, "username", req.Username)
+	req.ServerName = server.PathOr(r, "server_name", req.ServerName)
+	if !validateVhostRequest(w, req) {
+		return
+	}
+	if !VhostExists(req.ServerName, req.Username) {
+		response.WriteError(w, ErrVhostNotFound)
+		return
+	}
+	// Edits re-render the template; raw config is never accepted since
+	// nginx opens the files it names as root.
+	content, err := renderRequest(req)
+	if err != nil {
+		response.FromError(w, err)
+		return
+	}
+	if err := WriteVhost(req.ServerName, req.Username, content); err != nil {
+		response.FromError(w, err)
+		return
+	}
+	response.OK(w, VhostResponse{Message: "Vhost updated", Content: content})
+}
+
+func GetVhostHandler(w http.ResponseWriter, r *http.Request) {
+	username := server.PathOr(r, "username", r.URL.Query().Get("username"))
+	serverName := server.PathOr(r, "server_name", r.URL.Query().Get("server_name"))
+	if !isValidName(username) || !isValidName(serverName) {
+		response.BadRequest(w, "Missing or invalid username/server_name")
+		return
+	}
+	content, err := ReadVhost(serverName, username)
+	if err != nil {
+		response.FromError(w, err)
+		return
+	}
+	response.OK(w, VhostResponse{Content: content})
+}
+
+func DeleteVhostHandler(w http.ResponseWriter, r *http.Request) {
+	var req DeleteVhostRequest
+	if err := server.DecodeJSON(r, &req); err != nil {
+		response.BadRequest(w, "Invalid request")
+		return
+	}
+	req.Username = server.PathOr(r, "username", req.Username)
+	req.ServerName = server.PathOr(r, "server_name", req.ServerName)
+	if !isValidName(req.Username) || !isValidName(req.ServerName) {
+		response.BadRequest(w, "Missing or invalid username/server_name")
+		return
+	}
+	if err := DeleteVhost(req.ServerName, req.Username); err != nil {
+		response.FromError(w, err)
+		return
+	}
+	response.OK(w, response.Message{Message: "Vhost deleted"})
+}
@@ -0,0 +1,203 @@
+package nginx
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+
+	"agent/response"
+)
+
+var (
+	vhostDir = "/etc/nginx/conf.d"
+	// Serialises write/validate/reload so concurrent edits cannot
+	// validate each other's half-written files.
+	vhostMutex sync.Mutex
+)
+
+var (
+	ErrVhostExists   = response.NewError(http.StatusConflict, "vhost_exists", "vhost already exists")
+	ErrVhostNotFound = response.NewError(http.StatusNotFound, "vhost_not_found", "vhost does not exist")
+	// ErrConfigInvalid carries the nginx -t output as details.
+	ErrConfigInvalid = response.NewError(http.StatusUnprocessableEntity, "nginx_config_invalid", "nginx config test failed")
+)
+
+func InitNginx(dir string) {
+	if dir != "" {
+		vhostDir = dir
+	}
+}
+
+type Vhost struct {
+	Username    string
+	ServerName  string
+	Aliases     []string
+	PHPUpstream string
+}
+
+var vhostTemplate = template.Must(template.New("vhost").Parse(`server {
+    listen 80;
+    listen [::]:80;
+    server_name {{.ServerName}}{{range .Aliases}} {{.}}{{end}};
+
+    root {{.DomainDir}}/public_html;
+    index index.php index.html index.htm;
+
+    access_log {{.DomainDir}}/logs/access.log;
+    error_log {{.DomainDir}}/logs/error.log;
+    client_body_temp_path {{.DomainDir}}/tmp;
+
+    include {{.ConfigDir}}/*.conf;
+
+    location / {
+        try_files $uri $uri/ {{if .PHPUpstream}}/index.php?$query_string{{else}}=404{{end}};
+    }
+{{if .PHPUpstream}}
+    location ~ \.php$ {
+        try_files $uri =404;
+        include fastcgi_params;
+        fastcgi_param SCRIPT_FILENAME $document_root$fastcgi_script_name;
+        fastcgi_pass {{.PHPUpstream}};
+    }
+{{end}}
+    location ~ /\.(?!well-known) {
+        deny all;
+    }
+}
+`))
+
+// Render builds the server block for the directory layout produced by
+// user.CreateHome.
+func Render(v Vhost) (string, error) {
+	data := struct {
+		Vhost
+		DomainDir string
+		ConfigDir string
+	}{
+		Vhost:     v,
+		DomainDir: filepath.Join("/home", v.Username, v.ServerName),
+		ConfigDir: filepath.Join("/home/configs", v.Username, v.ServerName, "config"),
+	}
+	var buf bytes.Buffer
+	if err := vhostTemplate.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// vhostPath separates the names with "+", which validName rejects, so
+// no two user/domain pairs share a file.
+func vhostPath(serverName, username string) string {
+	return filepath.Join(vhostDir, username+"+"+serverName+".conf")
+}
+
+func VhostExists(serverName, username string) bool {
+	_, err := os.Stat(vhostPath(serverName, username))
+	return err == nil
+}
+
+func ReadVhost(serverName, username string) (string, error) {
+	data, err := os.ReadFile(vhostPath(serverName, username))
+	if os.IsNotExist(err) {
+		return "", ErrVhostNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// WriteVhost installs content as the vhost for serverName, validates the
+// whole nginx config and reloads. The previous file is restored when
+// validation fails.
+func WriteVhost(serverName, username, content string) error {
+	vhostMutex.Lock()
+	defer vhostMutex.Unlock()
+
+	path := vhostPath(serverName, username)
+	previous, readErr := os.ReadFile(path)
+	hadPrevious := readErr == nil
+
+	if err := os.MkdirAll(vhostDir, 0755); err != nil {
+		return errors.New("failed to create vhost directory: " + vhostDir)
+	}
+	if err := writeFileAtomic(path, []byte(content)); err != nil {
+		return errors.New("failed to write vhost: " + err.Error())
+	}
+
+	if err := testConfig(); err != nil {
+		if hadPrevious {
+			writeFileAtomic(path, previous)
+		} else {
+			os.Remove(path)
+		}
+		return err
+	}
+	return reload()
+}
+
+// DeleteVhost removes the vhost for serverName and reloads, putting the
+// file back when the remaining config does not validate.
+func DeleteVhost(serverName, username string) error {
+	vhostMutex.Lock()
+	defer vhostMutex.Unlock()
+
+	path := vhostPath(serverName, username)
+	previous, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ErrVhostNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return errors.New("failed to remove vhost: " + err.Error())
+	}
+
+	if err := testConfig(); err != nil {
+		writeFileAtomic(path, previous)
+		return err
+	}
+	return reload()
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func testConfig() error {
+	out, err := exec.Command("nginx", "-t").CombinedOutput()
+	if err != nil {
+		return ErrConfigInvalid.WithDetails(map[string]string{"output": strings.TrimSpace(string(out))})
+	}
+	return nil
+}
+
+func reload() error {
+	out, err := exec.Command("nginx", "-s", "reload").CombinedOutput()
+	if err != nil {
+		return errors.New("failed to reload nginx: " + strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+// Package openapi builds an OpenAPI 3 document from the agent's route
+// table. Schemas are derived from the Go request and response types by
+// reflection, so the document cannot drift from what handlers decode and
+// encode.
+package openapi
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"agent/response"
+)
+
+// Operation describes one route.
+type Operation struct {
+	Method      string
+	Path        string // ServeMux pattern path, e.g. /v1/images/{ref...}
+	OperationID string
+	Summary     string
+	// Scope is the scope the route requires; empty means the route needs
+	// no credentials.
+	Scope string
+	// Status is the success status, 200 when zero.
+	Status int
+	Query  []Param
+	// Request and Response are zero values of the JSON body types; nil
+	// means there is no body.
+	Request  interface{}
+	Response interface{}
+	// ContentType of the success response, application/json when empty.
+	ContentType string
+}
+
+// Param is a query string parameter.
+type Param struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+type Info struct {
+	Title   string
+	Version string
+}
+
+var (
+	wildcard      = regexp.MustCompile(`\{([A-Za-z0-9_]+)(\.\.\.)?\}`)
+	componentName = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// Build returns the document as a JSON-ready map. It fails on operations
+// that are undocumented or declared twice.
+func Build(info Info, ops []Operation) (map[string]interface{}, error) {
+	b := &builder{
+		schemas: make(map[string]interface{}),
+		names:   make(map[reflect.Type]string),
+	}
+	errorSchema := b.schema(reflect.TypeOf(response.ErrorEnvelope{}))
+
+	paths := make(map[string]map[string]interface{})
+	seenRoute := make(map[string]bool)
+	seenID := make(map[string]bool)
+	for _, op := range ops {
+		key := op.Method + " " + op.Path
+		switch {
+		case op.Summary == "":
+			return nil, fmt.Errorf("openapi: %s has no summary", key)
+		case op.OperationID == "":
+			return nil, fmt.Errorf("openapi: %s has no operation id", key)
+		case seenRoute[key]:
+			return nil, fmt.Errorf("openapi: %s is declared twice", key)
+		case seenID[op.OperationID]:
+			return nil, fmt.Errorf("openapi: operation id %s is used twice", op.OperationID)
+		}
+		seenRoute[key] = true
+		seenID[op.OperationID] = true
+
+		var params []interface{}
+		for _, m := range wildcard.FindAllStringSubmatch(op.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, q := range op.Query {
+			params = append(params, map[string]interface{}{
+				"name":        q.Name,
+				"in":          "query",
+				"description": q.Description,
+				"schema":      map[string]interface{}{"type": q.Type},
+			})
+		}
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		if op.Response != nil {
+			contentType := op.ContentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			success["content"] = map[string]interface{}{
+				contentType: map[string]interface{}{"schema": b.schema(reflect.TypeOf(op.Response))},
+			}
+		}
+
+		operation := map[string]interface{}{
+			"operationId": op.OperationID,
+			"summary":     op.Summary,
+			"responses": map[string]interface{}{
+				fmt.Sprint(status): success,
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": errorSchema},
+					},
+				},
+			},
+		}
+		if op.Scope != "" {
+			operation["description"] = "Requires scope `" + op.Scope + "`."
+			operation["x-required-scope"] = op.Scope
+		} else {
+			operation["security"] = []interface{}{}
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(op.Request))},
+				},
+			}
+		}
+
+		p := wildcard.ReplaceAllString(op.Path, "{$1}")
+		if paths[p] == nil {
+			paths[p] = make(map[string]interface{})
+		}
+		paths[p][strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   info.Title,
+			"version": info.Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearerAuth": []string{}},
+		},
+	}, nil
+}
+
+type builder struct {
+	schemas map[string]interface{}
+	names   map[reflect.Type]string
+}
+
+// schema returns the schema for t. Named structs are emitted once under
+// components and referenced from everywhere else.
+func (b *builder) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType):
+		return map[string]interface{}{"type": "string"}
+	case t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType):
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64, reflect.Uintptr:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		return b.ref(t)
+	}
+	return map[string]interface{}{}
+}
+
+func (b *builder) ref(t reflect.Type) map[string]interface{} {
+	name, ok := b.names[t]
+	if !ok {
+		base := componentName.ReplaceAllString(path.Base(t.PkgPath())+"."+t.Name(), "_")
+		name = base
+		for i := 2; b.schemas[name] != nil; i++ {
+			name = fmt.Sprintf("%s%d", base, i)
+		}
+		b.names[t] = name
+		// Reserve the name before recursing so self-references resolve.
+		b.schemas[name] = map[string]interface{}{}
+		b.schemas[name] = b.object(t)
+	}
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func (b *builder) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	b.fields(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+// fields adds the JSON properties of t to props, promoting the fields of
+// untagged embedded structs the same way encoding/json does.
+func (b *builder) fields(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			b.fields(ft, props)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schema(f.Type)
+	}
+}
@@ -0,0 +1,153 @@
+// Package response writes the JSON bodies shared by every handler.
+//
+// Errors always use the envelope
+//
+//	{"error": {"code": "not_found", "message": "...", "details": ...}}
+//
+// where code is stable and meant for programs, and message is for humans.
+package response
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/client"
+)
+
+// Machine-readable error codes.
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeUnavailable      = "unavailable"
+	CodeInternal         = "internal_error"
+	// CodeRegistryUnauthorized is Docker or a registry refusing the
+	// agent's credentials, as opposed to the caller's.
+	CodeRegistryUnauthorized = "registry_unauthorized"
+)
+
+// Error is an error that knows its HTTP status and code. Packages declare
+// their failure modes as *Error values so handlers can pass them straight
+// to FromError.
+type Error struct {
+	Status  int         `json:"-"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func NewError(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// WithDetails returns a copy of e carrying details.
+func (e *Error) WithDetails(details interface{}) *Error {
+	c := *e
+	c.Details = details
+	return &c
+}
+
+// Is matches errors with the same code, so copies made by WithDetails
+// still satisfy errors.Is against the original.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// ErrorEnvelope is the body of every error response.
+type ErrorEnvelope struct {
+	Error *Error `json:"error"`
+}
+
+// Message is the body of responses that only confirm an action.
+type Message struct {
+	Message string `json:"message"`
+}
+
+// JSON writes v with the given status. The Content-Type header is set
+// before the status line so it is actually sent.
+func JSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// OK writes v with status 200.
+func OK(w http.ResponseWriter, v interface{}) {
+	JSON(w, http.StatusOK, v)
+}
+
+// Fail writes an error envelope.
+func Fail(w http.ResponseWriter, status int, code, message string) {
+	WriteError(w, NewError(status, code, message))
+}
+
+// BadRequest writes a 400 invalid_request error.
+func BadRequest(w http.ResponseWriter, message string) {
+	Fail(w, http.StatusBadRequest, CodeInvalidRequest, message)
+}
+
+// NotFound is the fallback handler for unknown routes.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	Fail(w, http.StatusNotFound, CodeNotFound, "No route for "+r.URL.Path)
+}
+
+func WriteError(w http.ResponseWriter, e *Error) {
+	recordError(w, e)
+	JSON(w, e.Status, ErrorEnvelope{Error: e})
+}
+
+// recordError hands e to the first writer in the Unwrap chain that wants
+// it, so the request log shows why a call failed.
+func recordError(w http.ResponseWriter, e *Error) {
+	for {
+		switch rw := w.(type) {
+		case interface{ RecordError(error) }:
+			rw.RecordError(e)
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
+// FromError maps err to an envelope: *Error values keep their own status,
+// Docker not-found/conflict/invalid errors become 404/409/400 and anything
+// else is a 500.
+func FromError(w http.ResponseWriter, err error) {
+	WriteError(w, Classify(err))
+}
+
+// Classify converts err to an *Error without writing it.
+func Classify(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	switch {
+	case cerrdefs.IsNotFound(err):
+		return NewError(http.StatusNotFound, CodeNotFound, err.Error())
+	case cerrdefs.IsConflict(err), cerrdefs.IsAlreadyExists(err):
+		return NewError(http.StatusConflict, CodeConflict, err.Error())
+	case cerrdefs.IsInvalidArgument(err):
+		return NewError(http.StatusBadRequest, CodeInvalidRequest, err.Error())
+	case cerrdefs.IsUnauthorized(err):
+		return NewError(http.StatusBadGateway, CodeRegistryUnauthorized, err.Error())
+	case cerrdefs.IsPermissionDenied(err):
+		return NewError(http.StatusForbidden, CodeForbidden, err.Error())
+	case cerrdefs.IsUnavailable(err), client.IsErrConnectionFailed(err):
+		return NewError(http.StatusServiceUnavailable, CodeUnavailable, err.Error())
+	}
+	return NewError(http.StatusInternalServerError, CodeInternal, err.Error())
+}
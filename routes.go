@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+
+	"agent/audit"
+	"agent/authorization"
+	"agent/docker"
+	"agent/logging"
+	"agent/metrics"
+	"agent/nginx"
+	"agent/openapi"
+	"agent/response"
+	"agent/server"
+	"agent/user"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+)
+
+// version is stamped from the VERSION file at build time.
+var version = "dev"
+
+// route is one endpoint of the versioned API. Identifiers travel in the
+// path; request bodies only carry the resource description. The
+// remaining fields feed the OpenAPI document.
+type route struct {
+	Method  string
+	Path    string
+	Scope   string
+	Handler http.HandlerFunc
+
+	Summary     string
+	Status      int
+	Query       []openapi.Param
+	Request     interface{}
+	Response    interface{}
+	ContentType string
+}
+
+var (
+	logsQuery = []openapi.Param{
+		{Name: "tail", Type: "string", Description: "Lines from the end of the log, or \"all\" (default 100)"},
+		{Name: "since", Type: "string", Description: "Only lines after this timestamp or relative duration"},
+		{Name: "until", Type: "string", Description: "Only lines before this timestamp or relative duration"},
+		{Name: "timestamps", Type: "boolean", Description: "Prefix lines with their timestamp"},
+		{Name: "stdout", Type: "boolean", Description: "Include stdout (default true)"},
+		{Name: "stderr", Type: "boolean", Description: "Include stderr (default true)"},
+		{Name: "follow", Type: "boolean", Description: "Stream new lines as server-sent events"},
+	}
+	execQuery = []openapi.Param{
+		{Name: "cmd", Type: "string", Description: "Command to run, one of exec.allowed_commands (default /bin/sh)"},
+		{Name: "user", Type: "string", Description: "User to run the command as, one of exec.allowed_users (default: the container's user)"},
+		{Name: "cols", Type: "integer", Description: "Initial terminal width"},
+		{Name: "rows", Type: "integer", Description: "Initial terminal height"},
+	}
+	auditQuery = []openapi.Param{
+		{Name: "since", Type: "string", Description: "Only records at or after this RFC 3339 time"},
+		{Name: "until", Type: "string", Description: "Only records at or before this RFC 3339 time"},
+		{Name: "route", Type: "string", Description: "Route pattern, e.g. \"POST /v1/containers/{id}/start\", or path prefix"},
+		{Name: "identity", Type: "string", Description: "Caller identity"},
+		{Name: "limit", Type: "integer", Description: "Newest records to return (default 100, max 1000)"},
+	}
+	eventsQuery = []openapi.Param{
+		{Name: "type", Type: "string", Description: "container, image, network or volume; repeatable or comma-separated"},
+		{Name: "label", Type: "string", Description: "Only events whose actor has this label, as key or key=value; repeatable"},
+		{Name: "since", Type: "string", Description: "Replay buffered events after this RFC 3339 time or Unix timestamp first"},
+	}
+	archiveQuery = []openapi.Param{
+		{Name: "archive", Type: "boolean", Description: "Archive the files before deleting them"},
+	}
+)
+
+var routes = []route{
+	{Method: "POST", Path: "/v1/users", Scope: authorization.ScopeUserCreate, Handler: user.CreateUserHandler,
+		Summary: "Create a system user and domain directory", Status: http.StatusCreated,
+		Request: user.CreateUserRequest{}, Response: response.Message{}},
+	{Method: "DELETE", Path: "/v1/users/{username}", Scope: authorization.ScopeUserDelete, Handler: user.DeleteUserHandler,
+		Summary: "Delete a system user and its home directory", Query: archiveQuery, Response: response.Message{}},
+	{Method: "DELETE", Path: "/v1/users/{username}/domains/{server_name}", Scope: authorization.ScopeUserDelete, Handler: user.DeleteDomainHandler,
+		Summary: "Delete a domain directory", Query: archiveQuery, Response: response.Message{}},
+
+	{Method: "POST", Path: "/v1/vhosts", Scope: authorization.ScopeNginxWrite, Handler: nginx.CreateVhostHandler,
+		Summary: "Render, install and load an nginx vhost", Status: http.StatusCreated,
+		Request: nginx.VhostRequest{}, Response: nginx.VhostResponse{}},
+	{Method: "GET", Path: "/v1/vhosts/{username}/{server_name}", Scope: authorization.ScopeNginxRead, Handler: nginx.GetVhostHandler,
+		Summary: "Read an nginx vhost", Response: nginx.VhostResponse{}},
+	{Method: "PUT", Path: "/v1/vhosts/{username}/{server_name}", Scope: authorization.ScopeNginxWrite, Handler: nginx.UpdateVhostHandler,
+		Summary: "Replace an nginx vhost", Request: nginx.VhostRequest{}, Response: nginx.VhostResponse{}},
+	{Method: "DELETE", Path: "/v1/vhosts/{username}/{server_name}", Scope: authorization.ScopeNginxWrite, Handler: nginx.DeleteVhostHandler,
+		Summary: "Delete an nginx vhost", Response: response.Message{}},
+
+	{Method: "GET", Path: "/v1/containers", Scope: authorization.ScopeContainerRead, Handler: docker.ListContainersHandler,
+		Summary: "List all containers", Response: []container.Summary{}},
+	{Method: "POST", Path: "/v1/containers", Scope: authorization.ScopeContainerWrite, Handler: docker.CreateContainerHandler,
+		Summary: "Create and start a container", Request: docker.CreateContainerRequest{}, Response: docker.CreateContainerResponse{}},
+	{Method: "GET", Path: "/v1/containers/{id}", Scope: authorization.ScopeContainerRead, Handler: docker.GetContainerByIDHandler,
+		Summary: "Inspect a container by id or name", Response: container.InspectResponse{}},
+	{Method: "DELETE", Path: "/v1/containers/{id}", Scope: authorization.ScopeContainerWrite, Handler: docker.DeleteContainerHandler,
+		Summary: "Force-remove a container", Response: response.Message{}},
+	{Method: "POST", Path: "/v1/containers/{id}/start", Scope: authorization.ScopeContainerWrite, Handler: docker.StartContainerHandler,
+		Summary: "Start a container", Response: response.Message{}},
+	{Method: "POST", Path: "/v1/containers/{id}/stop", Scope: authorization.ScopeContainerWrite, Handler: docker.StopContainerHandler,
+		Summary: "Stop a container", Response: response.Message{}},
+	{Method: "POST", Path: "/v1/containers/{id}/kill", Scope: authorization.ScopeContainerWrite, Handler: docker.KillContainerHandler,
+		Summary: "Send SIGKILL to a container", Response: response.Message{}},
+	{Method: "GET", Path: "/v1/containers/{id}/stats", Scope: authorization.ScopeContainerRead, Handler: docker.ContainerSnapshotHandler,
+		Summary: "Take a one-shot stats sample of a container", Response: docker.ContainerStatsSnapshot{}},
+	{Method: "GET", Path: "/v1/containers/{id}/logs", Scope: authorization.ScopeContainerRead, Handler: docker.ContainerLogsHandler,
+		Summary: "Read container logs, or follow them as server-sent events", Query: logsQuery, Response: docker.LogsResponse{}},
+	{Method: "GET", Path: "/v1/containers/{id}/exec", Scope: authorization.ScopeContainerExec, Handler: docker.ExecHandler,
+		Summary: "Open an interactive TTY in a container over a WebSocket", Status: http.StatusSwitchingProtocols, Query: execQuery},
+	{Method: "GET", Path: "/v1/stats", Scope: authorization.ScopeContainerRead, Handler: docker.ContainerStatsHandler,
+		Summary:  "Latest stats of every running container, or a server-sent event stream with stream=true",
+		Query:    []openapi.Param{{Name: "stream", Type: "boolean", Description: "Stream snapshots as server-sent events"}},
+		Response: docker.StatsResponse{}},
+	{Method: "GET", Path: "/v1/events", Scope: authorization.ScopeEventsRead, Handler: docker.EventsHandler,
+		Summary: "Stream Docker events as server-sent events, or over a WebSocket when upgrading",
+		Query:   eventsQuery, Response: docker.Event{}, ContentType: "text/event-stream"},
+
+	{Method: "GET", Path: "/v1/networks", Scope: authorization.ScopeNetworkRead, Handler: docker.ListNetworksHandler,
+		Summary: "List networks", Response: docker.NetworkListResponse{}},
+	{Method: "POST", Path: "/v1/networks", Scope: authorization.ScopeNetworkAdmin, Handler: docker.CreateNetworkHandler,
+		Summary: "Create a network", Status: http.StatusCreated, Request: docker.CreateNetworkRequest{}, Response: docker.CreateNetworkResponse{}},
+	{Method: "DELETE", Path: "/v1/networks/{id}", Scope: authorization.ScopeNetworkAdmin, Handler: docker.DeleteNetworkHandler,
+		Summary: "Delete a network", Response: response.Message{}},
+	{Method: "POST", Path: "/v1/networks/{id}/connect", Scope: authorization.ScopeNetworkAdmin, Handler: docker.ConnectNetworkHandler,
+		Summary: "Connect a container to a network", Request: docker.ConnectNetworkRequest{}, Response: response.Message{}},
+	{Method: "POST", Path: "/v1/networks/{id}/disconnect", Scope: authorization.ScopeNetworkAdmin, Handler: docker.DisconnectNetworkHandler,
+		Summary: "Disconnect a container from a network", Request: docker.DisconnectNetworkRequest{}, Response: response.Message{}},
+
+	{Method: "GET", Path: "/v1/images", Scope: authorization.ScopeImageRead, Handler: docker.ListImagesHandler,
+		Summary: "List images", Response: []image.Summary{}},
+	{Method: "POST", Path: "/v1/images", Scope: authorization.ScopeImagePull, Handler: docker.PullImageHandler,
+		Summary: "Pull an image, streaming progress as NDJSON", Request: docker.PullImageRequest{},
+		Response: docker.PullProgress{}, ContentType: "application/x-ndjson"},
+	{Method: "DELETE", Path: "/v1/images/{ref...}", Scope: authorization.ScopeImageDelete, Handler: docker.DeleteImageHandler,
+		Summary: "Force-remove an image", Response: response.Message{}},
+
+	{Method: "GET", Path: "/audit/query", Scope: authorization.ScopeAuditRead, Handler: audit.QueryHandler,
+		Summary: "Search the audit log", Query: auditQuery, Response: audit.QueryResponse{}},
+}
+
+// publicRoutes need no API credentials. /metrics applies its own token
+// and allowlist.
+var publicRoutes = []route{
+	{Method: "GET", Path: "/healthz", Handler: server.HealthHandler,
+		Summary: "Liveness probe", Response: server.ReadyResponse{}},
+	{Method: "GET", Path: "/readyz", Handler: server.ReadyHandler,
+		Summary: "Readiness probe; 503 while a dependency fails or the agent drains", Response: server.ReadyResponse{}},
+	{Method: "GET", Path: "/metrics", Handler: metrics.ScrapeHandler,
+		Summary: "Prometheus metrics, when metrics.enabled is set", Response: "", ContentType: "text/plain"},
+}
+
+// legacyRoute is a pre-/v1 path. It still accepts any method and reads
+// identifiers from the body or query string, as it always has.
+type legacyRoute struct {
+	Path      string
+	Successor string
+	Scope     string
+	Handler   http.HandlerFunc
+}
+
+var legacyRoutes = []legacyRoute{
+	{"/system/user/create", "/v1/users", authorization.ScopeUserCreate, user.CreateUserHandler},
+	{"/system/user/delete", "/v1/users/{username}", authorization.ScopeUserDelete, user.DeleteUserHandler},
+	{"/system/user/domain/delete", "/v1/users/{username}/domains/{server_name}", authorization.ScopeUserDelete, user.DeleteDomainHandler},
+
+	{"/nginx/vhost/create", "/v1/vhosts", authorization.ScopeNginxWrite, nginx.CreateVhostHandler},
+	{"/nginx/vhost/get", "/v1/vhosts/{username}/{server_name}", authorization.ScopeNginxRead, nginx.GetVhostHandler},
+	{"/nginx/vhost/update", "/v1/vhosts/{username}/{server_name}", authorization.ScopeNginxWrite, nginx.UpdateVhostHandler},
+	{"/nginx/vhost/delete", "/v1/vhosts/{username}/{server_name}", authorization.ScopeNginxWrite, nginx.DeleteVhostHandler},
+
+	{"/container/list", "/v1/containers", authorization.ScopeContainerRead, docker.ListContainersHandler},
+	{"/container/delete", "/v1/containers/{id}", authorization.ScopeContainerWrite, docker.DeleteContainerHandler},
+	{"/container/stop", "/v1/containers/{id}/stop", authorization.ScopeContainerWrite, docker.StopContainerHandler},
+	{"/container/start", "/v1/containers/{id}/start", authorization.ScopeContainerWrite, docker.StartContainerHandler},
+	{"/container/kill", "/v1/containers/{id}/kill", authorization.ScopeContainerWrite, docker.KillContainerHandler},
+	{"/container/create", "/v1/containers", authorization.ScopeContainerWrite, docker.CreateContainerHandler},
+	{"/container/get_by_id", "/v1/containers/{id}", authorization.ScopeContainerRead, docker.GetContainerByIDHandler},
+	{"/container/get_by_name", "/v1/containers/{id}", authorization.ScopeContainerRead, docker.GetContainerByNameHandler},
+	{"/container/stats", "/v1/stats", authorization.ScopeContainerRead, docker.ContainerStatsHandler},
+	{"/container/stats_by_name", "/v1/containers/{id}/stats", authorization.ScopeContainerRead, docker.GetContainerStatsByNameHandler},
+	{"/container/logs", "/v1/containers/{id}/logs", authorization.ScopeContainerRead, docker.ContainerLogsHandler},
+	{"/container/exec", "/v1/containers/{id}/exec", authorization.ScopeContainerExec, docker.ExecHandler},
+
+	{"/network/create", "/v1/networks", authorization.ScopeNetworkAdmin, docker.CreateNetworkHandler},
+	{"/network/list", "/v1/networks", authorization.ScopeNetworkRead, docker.ListNetworksHandler},
+	{"/network/delete", "/v1/networks/{id}", authorization.ScopeNetworkAdmin, docker.DeleteNetworkHandler},
+	{"/network/connect", "/v1/networks/{id}/connect", authorization.ScopeNetworkAdmin, docker.ConnectNetworkHandler},
+	{"/network/disconnect", "/v1/networks/{id}/disconnect", authorization.ScopeNetworkAdmin, docker.DisconnectNetworkHandler},
+
+	{"/image/list", "/v1/images", authorization.ScopeImageRead, docker.ListImagesHandler},
+	{"/image/pull", "/v1/images", authorization.ScopeImagePull, docker.PullImageHandler},
+	{"/image/delete", "/v1/images/{ref...}", authorization.ScopeImageDelete, docker.DeleteImageHandler},
+}
+
+// authenticated wraps h with authentication and the scope check. Calls
+// that need more than a read scope are audited, including rejected ones,
+// and every call is counted for /metrics.
+func authenticated(scope string, h http.HandlerFunc) http.Handler {
+	if strings.HasSuffix(scope, ":read") {
+		return metrics.Instrument(authorization.AuthMiddleware(authorization.RequireScope(scope, h)))
+	}
+	return metrics.Instrument(audit.Middleware(authorization.AuthMiddleware(audit.Identify(authorization.RequireScope(scope, h)))))
+}
+
+// router is the part of http.ServeMux that registerRoutes uses, so the
+// tests can see every pattern.
+type router interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+// registerRoutes installs the /v1 and public routes, a 405 fallback for
+// each of their paths, the deprecated legacy aliases and a 404 for
+// everything else.
+func registerRoutes(mux router) {
+	mux.Handle("/", http.HandlerFunc(response.NotFound))
+	allowed := make(map[string][]string)
+	for _, rt := range routes {
+		mux.Handle(rt.Method+" "+rt.Path, authenticated(rt.Scope, rt.Handler))
+		allowed[rt.Path] = append(allowed[rt.Path], rt.Method)
+	}
+	for _, rt := range publicRoutes {
+		mux.Handle(rt.Method+" "+rt.Path, rt.Handler)
+		allowed[rt.Path] = append(allowed[rt.Path], rt.Method)
+	}
+	for path, methods := range allowed {
+		mux.Handle(path, methodNotAllowed(methods))
+	}
+
+	spec, err := openapiSpec()
+	if err != nil {
+		logging.Fatal(err.Error())
+	}
+	mux.Handle("GET /openapi.json", authorization.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	})))
+	mux.Handle("/openapi.json", methodNotAllowed([]string{"GET"}))
+	for _, lr := range legacyRoutes {
+		mux.Handle(lr.Path, deprecated(lr.Successor, authenticated(lr.Scope, lr.Handler)))
+	}
+}
+
+// methodNotAllowed answers requests whose path matched a /v1 route but
+// whose method did not.
+func methodNotAllowed(methods []string) http.Handler {
+	allow := append([]string(nil), methods...)
+	for _, m := range methods {
+		if m == "GET" {
+			allow = append(allow, "HEAD")
+		}
+	}
+	sort.Strings(allow)
+	header := strings.Join(allow, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", header)
+		response.Fail(w, http.StatusMethodNotAllowed, response.CodeMethodNotAllowed, r.Method+" is not allowed; use "+header)
+	})
+}
+
+// deprecated marks responses from legacy paths and points at the /v1
+// replacement.
+func deprecated(successor string, next http.Handler) http.Handler {
+	link := "<" + successor + `>; rel="successor-version"`
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", link)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// openapiSpec renders the document for the /v1 and public route tables.
+// routes_test.go checks that every registered pattern is documented.
+func openapiSpec() ([]byte, error) {
+	ops := make([]openapi.Operation, 0, len(routes)+len(publicRoutes))
+	for _, rt := range append(append([]route(nil), routes...), publicRoutes...) {
+		ops = append(ops, openapi.Operation{
+			Method:      rt.Method,
+			Path:        rt.Path,
+			OperationID: operationID(rt.Handler),
+			Summary:     rt.Summary,
+			Scope:       rt.Scope,
+			Status:      rt.Status,
+			Query:       rt.Query,
+			Request:     rt.Request,
+			Response:    rt.Response,
+			ContentType: rt.ContentType,
+		})
+	}
+	doc, err := openapi.Build(openapi.Info{Title: "raweb agent", Version: version}, ops)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// operationID derives a stable id from the handler name, e.g.
+// docker.StartContainerHandler becomes startContainer.
+func operationID(h http.HandlerFunc) string {
+	name := runtime.FuncForPC(reflect.ValueOf(h).Pointer()).Name()
+	name = strings.TrimSuffix(name[strings.LastIndexByte(name, '.')+1:], "Handler")
+	if name == "" {
+		return ""
+	}
+	return strings.ToLower(name[:1]) + name[1:]
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// recordingMux keeps every registered pattern and passes it on to a real
+// ServeMux, which panics on conflicting patterns.
+type recordingMux struct {
+	mux      *http.ServeMux
+	patterns []string
+}
+
+func (m *recordingMux) Handle(pattern string, handler http.Handler) {
+	m.patterns = append(m.patterns, pattern)
+	m.mux.Handle(pattern, handler)
+}
+
+// undocumented are the registered patterns deliberately left out of the
+// OpenAPI document.
+var undocumented = map[string]string{
+	"/":                 "404 fallback",
+	"GET /openapi.json": "the document itself",
+	"/openapi.json":     "405 fallback for the document",
+}
+
+func TestEveryRouteIsDocumented(t *testing.T) {
+	rec := &recordingMux{mux: http.NewServeMux()}
+	registerRoutes(rec)
+
+	spec, err := openapiSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	legacy := make(map[string]string)
+	for _, lr := range legacyRoutes {
+		legacy[lr.Path] = lr.Successor
+	}
+
+	for _, pattern := range rec.patterns {
+		if _, ok := undocumented[pattern]; ok {
+			continue
+		}
+		method, path, hasMethod := strings.Cut(pattern, " ")
+		if !hasMethod {
+			method, path = "", pattern
+		}
+		if successor, ok := legacy[path]; ok && method == "" {
+			if doc.Paths[specPath(successor)] == nil {
+				t.Errorf("legacy %s points at undocumented %s", path, successor)
+			}
+			continue
+		}
+		ops := doc.Paths[specPath(path)]
+		if ops == nil {
+			t.Errorf("%s: path missing from the OpenAPI document", pattern)
+			continue
+		}
+		// A method-less pattern is the 405 fallback of a documented path.
+		if method != "" && ops[strings.ToLower(method)] == nil {
+			t.Errorf("%s: operation missing from the OpenAPI document", pattern)
+		}
+	}
+}
+
+// specPath turns a ServeMux wildcard such as {ref...} into its OpenAPI
+// form {ref}.
+func specPath(pattern string) string {
+	return strings.ReplaceAll(pattern, "...}", "}")
+}
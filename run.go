@@ -1,42 +1,104 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
+	"agent/audit"
 	"agent/authorization"
 	"agent/docker"
+	"agent/logging"
+	"agent/metrics"
+	"agent/nginx"
+	"agent/server"
 	"agent/user"
 )
 
 type AgentConfig struct {
-	Port        string `json:"port"`
-	ProjectPath string `json:"project_path"`
-	Docker      string `json:"docker"`
+	Bind            string                  `json:"bind"`
+	Port            string                  `json:"port"`
+	ProjectPath     string                  `json:"project_path"`
+	Docker          string                  `json:"docker"`
+	NginxVhosts     string                  `json:"nginx_vhosts"`
+	Exec            docker.ExecConfig       `json:"exec"`
+	TLS             server.TLSConfig        `json:"tls"`
+	UnixSocket      server.UnixSocketConfig `json:"unix_socket"`
+	ShutdownTimeout string                  `json:"shutdown_timeout"`
+	ReadinessGrace  string                  `json:"readiness_grace"`
+	Audit           audit.Config            `json:"audit"`
+	Metrics         metrics.Config          `json:"metrics"`
+	Logging         logging.Config          `json:"logging"`
+	Events          docker.EventsConfig     `json:"events"`
 }
 
 func loadConfig(configPath string) AgentConfig {
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		logging.Fatal(err.Error())
+	}
+	return cfg
+}
+
+func readConfig(configPath string) (AgentConfig, error) {
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		log.Fatalf("Config file does not exist: %s", configPath)
+		return AgentConfig{}, fmt.Errorf("Config file does not exist: %s", configPath)
 	}
 
 	file, err := os.Open(configPath)
 	if err != nil {
-		log.Fatalf("Failed to open config file %s: %v", configPath, err)
+		return AgentConfig{}, fmt.Errorf("Failed to open config file %s: %v", configPath, err)
 	}
 	defer file.Close()
 
 	var cfg AgentConfig
 	if err := json.NewDecoder(file).Decode(&cfg); err != nil {
-		log.Fatalf("Failed to parse config file %s: %v", configPath, err)
+		return AgentConfig{}, fmt.Errorf("Failed to parse config file %s: %v", configPath, err)
 	}
 
-	return cfg
+	return cfg, nil
+}
+
+// reloadConfig applies a changed config.json and panel .env on SIGHUP.
+// Everything is validated before anything is applied, so a bad config
+// leaves the running one untouched. Listener settings need a restart.
+func reloadConfig(configPath string) {
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		slog.Error("Reload rejected", "error", err)
+		return
+	}
+	if err := docker.ValidateHost(cfg.Docker); err != nil {
+		slog.Error("Reload rejected: invalid docker host", "host", cfg.Docker, "error", err)
+		return
+	}
+	if _, err := logging.ParseLevel(cfg.Logging.Level); err != nil {
+		slog.Error("Reload rejected", "error", err)
+		return
+	}
+	applyAuth, err := authorization.PrepareReload(cfg.ProjectPath, configPath)
+	if err != nil {
+		slog.Error("Reload rejected", "error", err)
+		return
+	}
+	applyDocker, err := docker.PrepareReload(cfg.Docker)
+	if err != nil {
+		slog.Error("Reload rejected: could not create docker client", "host", cfg.Docker, "error", err)
+		return
+	}
+	applyAuth()
+	applyDocker()
+	logging.SetLevel(cfg.Logging.Level)
+	slog.Info("Configuration reloaded", "config", configPath)
 }
 
 func printUsage() {
@@ -74,30 +136,121 @@ func main() {
     }
 
     cfg := loadConfig(configPath)
-    authorization.InitAuthWithPath(cfg.ProjectPath)
+    if err := logging.Init(cfg.Logging); err != nil {
+        logging.Fatal(err.Error())
+    }
+    authorization.InitAuthWithPath(cfg.ProjectPath, configPath)
     docker.InitDocker(cfg.Docker)
+    docker.InitExec(cfg.Exec)
+    if err := audit.Init(cfg.Audit); err != nil {
+        logging.Fatal(err.Error())
+    }
+    defer audit.Close()
+
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+    defer stop()
+    backgroundCtx, stopBackground := context.WithCancel(context.Background())
+    defer stopBackground()
+    docker.StartStatsCollector(backgroundCtx, 5*time.Second)
+    if err := docker.StartEventRelay(backgroundCtx, cfg.Events); err != nil {
+        logging.Fatal(err.Error())
+    }
+    nginx.InitNginx(cfg.NginxVhosts)
+
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+        for range hup {
+            reloadConfig(configPath)
+        }
+    }()
 
     mux := http.NewServeMux()
-    mux.Handle("/system/user/create", authorization.AuthMiddleware(http.HandlerFunc(user.CreateUserHandler)))
-
-    mux.Handle("/container/list", authorization.AuthMiddleware(http.HandlerFunc(docker.ListContainersHandler)))
-    mux.Handle("/container/delete", authorization.AuthMiddleware(http.HandlerFunc(docker.DeleteContainerHandler)))
-    mux.Handle("/container/stop", authorization.AuthMiddleware(http.HandlerFunc(docker.StopContainerHandler)))
-    mux.Handle("/container/start", authorization.AuthMiddleware(http.HandlerFunc(docker.StartContainerHandler)))
-    mux.Handle("/container/kill", authorization.AuthMiddleware(http.HandlerFunc(docker.KillContainerHandler)))
-    mux.Handle("/container/create", authorization.AuthMiddleware(http.HandlerFunc(docker.CreateContainerHandler)))
-    mux.Handle("/container/get_by_id", authorization.AuthMiddleware(http.HandlerFunc(docker.GetContainerByIDHandler)))
-    mux.Handle("/container/get_by_name", authorization.AuthMiddleware(http.HandlerFunc(docker.GetContainerByNameHandler)))
-    mux.Handle("/container/stats_by_name", authorization.AuthMiddleware(http.HandlerFunc(docker.GetContainerStatsByNameHandler)))
-
-    mux.Handle("/network/create", authorization.AuthMiddleware(http.HandlerFunc(docker.CreateNetworkHandler)))
-    mux.Handle("/network/list", authorization.AuthMiddleware(http.HandlerFunc(docker.ListNetworksHandler)))
-    mux.Handle("/network/delete", authorization.AuthMiddleware(http.HandlerFunc(docker.DeleteNetworkHandler)))
-
-    mux.Handle("/image/list", authorization.AuthMiddleware(http.HandlerFunc(docker.ListImagesHandler)))
-    mux.Handle("/image/delete", authorization.AuthMiddleware(http.HandlerFunc(docker.DeleteImageHandler)))
-
-    log.Printf("Agent starting with config: %s", configPath)
-    log.Printf("Agent running on :%s (project path: %s)\n", cfg.Port, cfg.ProjectPath)
-    log.Fatal(http.ListenAndServe(":"+cfg.Port, mux))
+    server.AddReadyCheck("docker", docker.Ping)
+    server.AddReadyCheck("env", authorization.CheckEnv)
+    server.AddReadyCheck("commands", user.CheckCommands)
+    registerRoutes(mux)
+    if cfg.Metrics.Enabled {
+        metrics.Register(docker.WriteContainerMetrics)
+    }
+    metrics.Init(cfg.Metrics)
+
+    addr := net.JoinHostPort(cfg.Bind, cfg.Port)
+    srv := &http.Server{
+        Addr:              addr,
+        Handler:           logging.Middleware(mux),
+        ConnContext:       server.ConnContext,
+        ReadHeaderTimeout: 10 * time.Second,
+        ReadTimeout:       60 * time.Second,
+        WriteTimeout:      120 * time.Second,
+        IdleTimeout:       120 * time.Second,
+    }
+
+    slog.Info("Agent starting", "config", configPath)
+    serveErr := make(chan error, 2)
+    if cfg.UnixSocket.Path != "" {
+        ul, err := server.ListenUnix(cfg.UnixSocket)
+        if err != nil {
+            logging.Fatal("Failed to listen on unix socket", "path", cfg.UnixSocket.Path, "error", err)
+        }
+        slog.Info("Agent running", "addr", "unix:"+cfg.UnixSocket.Path, "project_path", cfg.ProjectPath)
+        go func() {
+            serveErr <- srv.Serve(ul)
+        }()
+    }
+    if cfg.Port != "" {
+        if cfg.TLS.Enabled() {
+            tlsConfig, err := server.NewTLSConfig(cfg.TLS)
+            if err != nil {
+                logging.Fatal("Invalid tls config", "error", err)
+            }
+            srv.TLSConfig = tlsConfig
+            slog.Info("Agent running", "addr", "https://"+addr, "project_path", cfg.ProjectPath)
+            go func() {
+                serveErr <- srv.ListenAndServeTLS("", "")
+            }()
+        } else {
+            slog.Info("Agent running", "addr", addr, "project_path", cfg.ProjectPath)
+            go func() {
+                serveErr <- srv.ListenAndServe()
+            }()
+        }
+    }
+    if cfg.Port == "" && cfg.UnixSocket.Path == "" {
+        logging.Fatal("Nothing to listen on: set port and/or unix_socket.path")
+    }
+
+    select {
+    case err := <-serveErr:
+        logging.Fatal(err.Error())
+    case <-ctx.Done():
+    }
+
+    // Stop accepting new connections, report not-ready and give in-flight
+    // operations (container create, CreateHome, ...) time to finish.
+    shutdownTimeout := 25 * time.Second
+    if cfg.ShutdownTimeout != "" {
+        if d, err := time.ParseDuration(cfg.ShutdownTimeout); err == nil {
+            shutdownTimeout = d
+        }
+    }
+    // Keep serving while /readyz reports draining so load balancers stop
+    // routing here first. The grace period counts towards the timeout.
+    readinessGrace := 5 * time.Second
+    if cfg.ReadinessGrace != "" {
+        if d, err := time.ParseDuration(cfg.ReadinessGrace); err == nil && d >= 0 {
+            readinessGrace = d
+        }
+    }
+    readinessGrace = min(readinessGrace, shutdownTimeout)
+    slog.Info("Shutting down, draining in-flight requests", "timeout", shutdownTimeout.String(), "readiness_grace", readinessGrace.String())
+    server.BeginDrain()
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+    defer cancel()
+    time.Sleep(readinessGrace)
+    if err := srv.Shutdown(shutdownCtx); err != nil {
+        slog.Warn("Shutdown did not complete", "error", err)
+    }
+    stopBackground()
+    slog.Info("Agent stopped")
 }
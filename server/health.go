@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Each readiness check gets this long before it counts as failed.
+const checkTimeout = 3 * time.Second
+
+type readyCheck struct {
+	name string
+	run  func(context.Context) error
+}
+
+var (
+	checksMu sync.Mutex
+	checks   []readyCheck
+)
+
+// AddReadyCheck registers a dependency that /readyz verifies on every
+// call. run should return promptly once ctx is done.
+func AddReadyCheck(name string, run func(context.Context) error) {
+	checksMu.Lock()
+	defer checksMu.Unlock()
+	checks = append(checks, readyCheck{name: name, run: run})
+}
+
+// CheckResult is the outcome of one readiness check.
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ReadyResponse is the body of /readyz.
+type ReadyResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// HealthHandler answers as long as the process can serve requests. It
+// checks nothing else so a supervisor does not restart the agent over a
+// dependency it cannot fix.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, ReadyResponse{Status: "ok"})
+}
+
+// ReadyHandler runs the registered checks concurrently and reports 503
+// when any fails or while the agent is draining.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if Draining() {
+		writeStatus(w, http.StatusServiceUnavailable, ReadyResponse{Status: "draining"})
+		return
+	}
+
+	checksMu.Lock()
+	list := make([]readyCheck, len(checks))
+	copy(list, checks)
+	checksMu.Unlock()
+
+	results := make([]CheckResult, len(list))
+	var wg sync.WaitGroup
+	for i, c := range list {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runCheck(r.Context(), c)
+		}()
+	}
+	wg.Wait()
+
+	resp := ReadyResponse{Status: "ready", Checks: make(map[string]CheckResult, len(list))}
+	status := http.StatusOK
+	for i, c := range list {
+		resp.Checks[c.name] = results[i]
+		if results[i].Status != "ok" {
+			resp.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeStatus(w, status, resp)
+}
+
+func runCheck(ctx context.Context, c readyCheck) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	start := time.Now()
+	err := c.run(ctx)
+	res := CheckResult{
+		Status:    "ok",
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Status = "failed"
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func writeStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
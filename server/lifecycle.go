@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	draining     atomic.Bool
+	stopping     = make(chan struct{})
+	stoppingOnce sync.Once
+)
+
+// BeginDrain marks the agent as not ready and tells long-lived streams
+// to finish. Ordinary requests are left to http.Server.Shutdown.
+func BeginDrain() {
+	draining.Store(true)
+	stoppingOnce.Do(func() { close(stopping) })
+}
+
+func Draining() bool {
+	return draining.Load()
+}
+
+// StreamContext returns a context for streaming handlers (SSE, follow,
+// WebSocket) that is cancelled with the request or when draining starts,
+// so they do not hold up shutdown until the deadline.
+func StreamContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCred(c *net.UnixConn) (PeerCred, error) {
+	return PeerCred{}, errors.New("peer credentials are only supported on linux")
+}
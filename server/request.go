@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// IsV1 reports whether r was routed through a /v1 pattern.
+func IsV1(r *http.Request) bool {
+	pattern := r.Pattern
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		pattern = pattern[i+1:]
+	}
+	return strings.HasPrefix(pattern, "/v1/")
+}
+
+// DecodeJSON decodes the request body into v. /v1 routes take their
+// identifiers from the path, so an empty body is accepted there and the
+// handler's own checks decide what is missing.
+func DecodeJSON(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == io.EOF && IsV1(r) {
+		return nil
+	}
+	return err
+}
+
+// PathOr returns the named path value, or fallback on legacy routes that
+// have no such wildcard.
+func PathOr(r *http.Request, name, fallback string) string {
+	if v := r.PathValue(name); v != "" {
+		return v
+	}
+	return fallback
+}
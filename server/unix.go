@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+type UnixSocketConfig struct {
+	Path  string `json:"path"`
+	Owner string `json:"owner"`
+	Group string `json:"group"`
+	Mode  string `json:"mode"`
+}
+
+// PeerCred identifies the process on the other end of a Unix socket.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+type contextKey int
+
+const peerCredKey contextKey = iota
+
+// ListenUnix replaces any stale socket at cfg.Path and applies the
+// configured owner, group and mode (default 0660).
+func ListenUnix(cfg UnixSocketConfig) (net.Listener, error) {
+	if fi, err := os.Lstat(cfg.Path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", cfg.Path)
+		}
+		if err := os.Remove(cfg.Path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := os.FileMode(0660)
+	if cfg.Mode != "" {
+		m, err := strconv.ParseUint(cfg.Mode, 8, 32)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("invalid unix_socket mode %q", cfg.Mode)
+		}
+		mode = os.FileMode(m)
+	}
+	if err := os.Chmod(cfg.Path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	uid, gid := -1, -1
+	if cfg.Owner != "" {
+		u, err := user.Lookup(cfg.Owner)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if cfg.Group != "" {
+		g, err := user.LookupGroup(cfg.Group)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(cfg.Path, uid, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// ConnContext is an http.Server ConnContext hook that records the peer
+// credentials of Unix socket connections.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, err := peerCred(uc)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey, cred)
+}
+
+// PeerCredFromContext returns the credentials stored by ConnContext.
+func PeerCredFromContext(ctx context.Context) (PeerCred, bool) {
+	cred, ok := ctx.Value(peerCredKey).(PeerCred)
+	return cred, ok
+}
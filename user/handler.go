@@ -4,6 +4,12 @@ import (
 	"encoding/json"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"agent/response"
+	"agent/server"
 )
 
 type CreateUserRequest struct {
@@ -11,41 +17,125 @@ type CreateUserRequest struct {
 	ServerName string `json:"server_name"`
 }
 
+type DeleteUserRequest struct {
+	Username string `json:"username"`
+	Archive  bool   `json:"archive"`
+}
+
+type DeleteDomainRequest struct {
+	Username   string `json:"username"`
+	ServerName string `json:"server_name"`
+	Archive    bool   `json:"archive"`
+}
+
 var validName = regexp.MustCompile(`^[a-zA-Z0-9.\-_]+$`)
 
 func isValidName(name string) bool {
-	return validName.MatchString(name)
+	return validName.MatchString(name) && name != "." && name != ".."
+}
+
+// isValidServerName also rejects a leading dot, which would name a hidden
+// directory such as .ssh in the user's home.
+func isValidServerName(name string) bool {
+	return isValidName(name) && !strings.HasPrefix(name, ".")
 }
 
-func writeJSONError(w http.ResponseWriter, message string, code int) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
+// clearWriteDeadline lifts the server's write timeout for calls that can
+// outlast it, such as archiving a whole home directory, so the caller
+// still learns the result.
+func clearWriteDeadline(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
 }
 
 func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 	var req CreateUserRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, "Invalid request", http.StatusBadRequest)
+		response.BadRequest(w, "Invalid request")
 		return
 	}
 	if req.Username == "" || req.ServerName == "" {
-		writeJSONError(w, "Username and server_name required", http.StatusBadRequest)
+		response.BadRequest(w, "Username and server_name required")
 		return
 	}
 	if !isValidName(req.Username) {
-		writeJSONError(w, "Invalid username: only letters, numbers, ., -, _ allowed", http.StatusBadRequest)
+		response.BadRequest(w, "Invalid username: only letters, numbers, ., -, _ allowed")
 		return
 	}
-	if !isValidName(req.ServerName) {
-		writeJSONError(w, "Invalid server_name: only letters, numbers, ., -, _ allowed", http.StatusBadRequest)
+	if !isValidServerName(req.ServerName) {
+		response.BadRequest(w, "Invalid server_name: only letters, numbers, ., -, _ allowed, not starting with .")
 		return
 	}
+	clearWriteDeadline(w)
 	if err := CreateHome(req.ServerName, req.Username); err != nil {
-		writeJSONError(w, "Failed: "+err.Error(), http.StatusInternalServerError)
+		response.FromError(w, err)
+		return
+	}
+	response.JSON(w, http.StatusCreated, response.Message{Message: "User and directories created"})
+}
+
+func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req DeleteUserRequest
+	if err := server.DecodeJSON(r, &req); err != nil {
+		response.BadRequest(w, "Invalid request")
+		return
+	}
+	req.Username = server.PathOr(r, "username", req.Username)
+	if v := r.URL.Query().Get("archive"); v != "" {
+		archive, err := strconv.ParseBool(v)
+		if err != nil {
+			response.BadRequest(w, "Invalid archive: expected true or false")
+			return
+		}
+		req.Archive = archive
+	}
+	if req.Username == "" {
+		response.BadRequest(w, "Username required")
+		return
+	}
+	if !isValidName(req.Username) {
+		response.BadRequest(w, "Invalid username: only letters, numbers, ., -, _ allowed")
+		return
+	}
+	clearWriteDeadline(w)
+	if err := DeleteUser(req.Username, req.Archive); err != nil {
+		response.FromError(w, err)
+		return
+	}
+	response.OK(w, response.Message{Message: "User deleted"})
+}
+
+func DeleteDomainHandler(w http.ResponseWriter, r *http.Request) {
+	var req DeleteDomainRequest
+	if err := server.DecodeJSON(r, &req); err != nil {
+		response.BadRequest(w, "Invalid request")
+		return
+	}
+	req.Username = server.PathOr(r, "username", req.Username)
+	req.ServerName = server.PathOr(r, "server_name", req.ServerName)
+	if v := r.URL.Query().Get("archive"); v != "" {
+		archive, err := strconv.ParseBool(v)
+		if err != nil {
+			response.BadRequest(w, "Invalid archive: expected true or false")
+			return
+		}
+		req.Archive = archive
+	}
+	if req.Username == "" || req.ServerName == "" {
+		response.BadRequest(w, "Username and server_name required")
+		return
+	}
+	if !isValidName(req.Username) {
+		response.BadRequest(w, "Invalid username: only letters, numbers, ., -, _ allowed")
+		return
+	}
+	if !isValidServerName(req.ServerName) {
+		response.BadRequest(w, "Invalid server_name: only letters, numbers, ., -, _ allowed, not starting with .")
+		return
+	}
+	clearWriteDeadline(w)
+	if err := DeleteDomain(req.ServerName, req.Username, req.Archive); err != nil {
+		response.FromError(w, err)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "User and directories created"})
+	response.OK(w, response.Message{Message: "Domain deleted"})
 }
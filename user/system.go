@@ -1,20 +1,63 @@
 package user
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"agent/response"
+)
+
+const (
+	archiveRoot = "/home/archives"
+	// agentShell is the login shell of the accounts CreateHome adds.
+	agentShell = "/usr/sbin/nologin"
 )
 
+// Errors callers are expected to tell apart. The codes are the strings
+// the panel used to match on before the JSON error envelope.
+var (
+	ErrDomainExists   = response.NewError(http.StatusConflict, "domain_exists", "domain directory already exists")
+	ErrDomainNotFound = response.NewError(http.StatusNotFound, "domain_not_found", "domain directory does not exist")
+	ErrUserNotFound   = response.NewError(http.StatusNotFound, "user_not_found", "user does not exist")
+	ErrSystemUser     = response.NewError(http.StatusForbidden, "system_user", "refusing to delete system user")
+	ErrUnmanagedUser  = response.NewError(http.StatusForbidden, "unmanaged_user", "refusing to delete a user the agent did not create")
+	ErrReservedName   = response.NewError(http.StatusBadRequest, "reserved_name", "name is reserved")
+	ErrInvalidPath    = response.NewError(http.StatusBadRequest, "invalid_path", "path leaves its parent directory")
+)
+
+// reservedNames are directories under /home that belong to the agent,
+// not to an account.
+var reservedNames = map[string]bool{"configs": true, "archives": true}
+
+// childPath joins name onto parent and checks the result is a direct
+// child of parent, so names like ".." cannot reach elsewhere.
+func childPath(parent, name string) (string, error) {
+	p := filepath.Join(parent, name)
+	if name == "" || filepath.Dir(p) != filepath.Clean(parent) || filepath.Base(p) != name {
+		return "", ErrInvalidPath.WithDetails(map[string]string{"name": name})
+	}
+	return p, nil
+}
+
 func CreateHome(serverName, username string) error {
+	if reservedNames[username] {
+		return ErrReservedName.WithDetails(map[string]string{"username": username})
+	}
 	userHome := "/home/" + username
 	domainDir := filepath.Join(userHome, serverName)
 
 	// 1. Create user if missing
 	if !userExists(username) {
-		cmd := exec.Command("useradd", "-m", "-d", userHome, "-s", "/usr/sbin/nologin", username)
+		cmd := exec.Command("useradd", "-m", "-d", userHome, "-s", agentShell, username)
 		if err := cmd.Run(); err != nil {
 			return errors.New("failed to create user: " + err.Error())
 		}
@@ -30,7 +73,7 @@ func CreateHome(serverName, username string) error {
 
 	// 3. If domain dir exists, return error
 	if _, err := os.Stat(domainDir); err == nil {
-		return errors.New("domain_exists")
+		return ErrDomainExists
 	}
 
 	// 4. Create domain dir and subdirs
@@ -61,6 +104,160 @@ func CreateHome(serverName, username string) error {
 	return nil
 }
 
+func DeleteDomain(serverName, username string, archive bool) error {
+	if reservedNames[username] {
+		return ErrReservedName.WithDetails(map[string]string{"username": username})
+	}
+	userHome, err := childPath("/home", username)
+	if err != nil {
+		return err
+	}
+	domainDir, err := childPath(userHome, serverName)
+	if err != nil {
+		return err
+	}
+	configRoot, err := childPath("/home/configs", username)
+	if err != nil {
+		return err
+	}
+	configDir, err := childPath(configRoot, serverName)
+	if err != nil {
+		return err
+	}
+
+	// 1. Domain dir must exist
+	if _, err := os.Stat(domainDir); os.IsNotExist(err) {
+		return ErrDomainNotFound
+	}
+
+	// 2. Archive domain and config dirs if requested
+	if archive {
+		name := username + "-" + serverName
+		if err := archivePaths(name, domainDir, configDir); err != nil {
+			return errors.New("failed to archive domain: " + err.Error())
+		}
+	}
+
+	// 3. Remove domain and config dirs
+	if err := os.RemoveAll(domainDir); err != nil {
+		return errors.New("failed to remove domain directory: " + domainDir)
+	}
+	if err := os.RemoveAll(configDir); err != nil {
+		return errors.New("failed to remove config directory: " + configDir)
+	}
+
+	return nil
+}
+
+func DeleteUser(username string, archive bool) error {
+	if reservedNames[username] {
+		return ErrReservedName.WithDetails(map[string]string{"username": username})
+	}
+	userHome, err := childPath("/home", username)
+	if err != nil {
+		return err
+	}
+	configDir, err := childPath("/home/configs", username)
+	if err != nil {
+		return err
+	}
+
+	// 1. User must exist and must not be a system account
+	if !userExists(username) {
+		return ErrUserNotFound
+	}
+	if isSystemUser(username) {
+		return ErrSystemUser.WithDetails(map[string]string{"username": username})
+	}
+	if !isManagedUser(username, configDir) {
+		return ErrUnmanagedUser.WithDetails(map[string]string{"username": username})
+	}
+
+	// 2. Archive home and config dirs if requested
+	if archive {
+		if err := archivePaths(username, userHome, configDir); err != nil {
+			return errors.New("failed to archive user: " + err.Error())
+		}
+	}
+
+	// 3. Remove the account, then whatever userdel left behind
+	if out, err := exec.Command("userdel", "-r", username).CombinedOutput(); err != nil {
+		// userdel exits 12 when only the home dir removal failed
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 12 {
+			return errors.New("failed to delete user: " + strings.TrimSpace(string(out)))
+		}
+	}
+	if err := os.RemoveAll(userHome); err != nil {
+		return errors.New("failed to remove home directory: " + userHome)
+	}
+	if err := os.RemoveAll(configDir); err != nil {
+		return errors.New("failed to remove config directory: " + configDir)
+	}
+
+	return nil
+}
+
+// archivePaths writes the existing paths into a timestamped tarball
+// under archiveRoot.
+func archivePaths(name string, paths ...string) error {
+	var existing []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			existing = append(existing, path)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(archiveRoot, 0700); err != nil {
+		return errors.New("failed to create archive directory: " + archiveRoot)
+	}
+	target := filepath.Join(archiveRoot, name+"-"+time.Now().Format("20060102-150405")+".tar.gz")
+	args := append([]string{"-czpf", target, "--absolute-names"}, existing...)
+	if out, err := exec.Command("tar", args...).CombinedOutput(); err != nil {
+		os.Remove(target)
+		return errors.New(strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// requiredCommands have to be on PATH to create and look up users.
+var requiredCommands = []string{"useradd", "id"}
+
+// CheckCommands reports the first required binary missing from PATH.
+func CheckCommands(ctx context.Context) error {
+	for _, name := range requiredCommands {
+		if _, err := exec.LookPath(name); err != nil {
+			return fmt.Errorf("%s not found in PATH", name)
+		}
+	}
+	return nil
+}
+
+func isSystemUser(username string) bool {
+	out, err := exec.Command("id", "-u", username).Output()
+	if err != nil {
+		return true
+	}
+	uid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	return err != nil || uid < 1000
+}
+
+// isManagedUser reports whether username looks like an account made by
+// CreateHome: it has a config directory and cannot log in. Admin logins
+// with a uid of 1000 or more fail this check.
+func isManagedUser(username, configDir string) bool {
+	if info, err := os.Stat(configDir); err != nil || !info.IsDir() {
+		return false
+	}
+	out, err := exec.Command("getent", "passwd", username).Output()
+	if err != nil {
+		return false
+	}
+	fields := strings.Split(strings.TrimSpace(string(out)), ":")
+	return len(fields) == 7 && fields[6] == agentShell
+}
+
 func userExists(username string) bool {
 	cmd := exec.Command("id", username)
 	err := cmd.Run()